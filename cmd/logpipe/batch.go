@@ -0,0 +1,223 @@
+package main
+
+import "time"
+
+// collector is a batch for the sinks that flush every f. the endpoints
+// share one, and its boxes, unless some have a flush= of their own
+type collector struct {
+	f     time.Duration
+	linec chan Log
+	dest  [][]*sink // like dests, but only this collector's sinks
+	emit  []bool    // the routes whose payloads it writes with -emit payload
+}
+
+// collectors returns a collector for each flush the sinks use, in the
+// order they first appear
+func collectors(sinks []*sink, dest [][]*sink) (cs []*collector) {
+	for _, s := range sinks {
+		f := *deadband
+		if s.flush > 0 {
+			f = s.flush
+		}
+		var c *collector
+		for _, have := range cs {
+			if have.f == f {
+				c = have
+			}
+		}
+		if c == nil {
+			c = &collector{f: f, linec: make(chan Log, *qlen), dest: make([][]*sink, len(dest)), emit: make([]bool, len(dest))}
+			cs = append(cs, c)
+		}
+		for r, d := range dest {
+			for _, ds := range d {
+				if ds == s {
+					c.dest[r] = append(c.dest[r], s)
+				}
+			}
+		}
+	}
+	// each payload is written once, by the first collector pushing it
+	for r := range dest {
+		for _, c := range cs {
+			if len(c.dest[r]) > 0 {
+				c.emit[r] = true
+				break
+			}
+		}
+	}
+	return cs
+}
+
+// fanout hands l to each collector with sendto. they each set seq and
+// repeated on their own goroutine, so all but the last get a clone, taken
+// before l is handed to anyone
+func fanout(cs []*collector, l Log, sendto func(chan Log, Log)) {
+	for i, c := range cs {
+		if i < len(cs)-1 {
+			sendto(c.linec, l.clone())
+		} else {
+			sendto(c.linec, l)
+		}
+	}
+}
+
+// every is how often a collector flushing every f ticks, never less than
+// a millisecond, a ticker cant tick any less
+func every(f time.Duration) time.Duration {
+	d := f
+	if *maxflush > 0 || *idle > 0 {
+		d = *minflush
+	}
+	if *idle > 0 && (d <= 0 || *idle/2 < d) {
+		d = *idle / 2
+	}
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// bin is where the logs for one route are collected
+type bin struct {
+	Box
+	oldest  time.Time // when the box got its first line
+	newest  time.Time // and its last, for -idle
+	flushed time.Time // and when the last box went out
+	size    int       // the box's Len, added up as lines go in
+}
+
+// batch collects the lines from linec into boxes, one for each route, see
+// routeof, and hands them to put along with their route, every tick, or
+// sooner when they are full. f is the -f it flushes on. it returns once
+// linec is closed and everything in it has been put
+func batch(linec <-chan Log, tick <-chan time.Time, f time.Duration, put func(int, Box)) {
+	shared := common()
+	sharedlen := shared.Len()
+	bins := make([]bin, len(rules)+1)
+	for i := range bins {
+		bins[i].flushed, bins[i].size = time.Now(), Box{}.Len()
+	}
+	inbox, size := part{n: &stats.inbox}, part{n: &stats.pending}
+	pending := func() (n int) {
+		lines := 0
+		for i := range bins {
+			if len(bins[i].Log) > 0 {
+				n += bins[i].size
+				lines += len(bins[i].Log)
+			}
+		}
+		inbox.set(lines)
+		return n
+	}
+	due := func(b *bin) bool {
+		if *idle > 0 && time.Since(b.newest) >= *idle {
+			return true
+		}
+		switch {
+		case *maxflush > 0:
+			return b.size >= *flushsize || time.Since(b.oldest) >= *maxflush
+		case *idle > 0:
+			return time.Since(b.oldest) >= f
+		}
+		return true
+	}
+	flush := func(r int) {
+		b := &bins[r]
+		if len(b.Log) == 0 {
+			dbg("flush: nothing to flush")
+			return
+		}
+		// the box is handed off to the pushers, which
+		// retry it while we carry on collecting into a fresh
+		// one. if every retry fails, the logs in it are lost.
+		b.Common = shared
+		put(r, b.Box)
+		b.Box, b.size = Box{}, Box{}.Len()
+		b.flushed = time.Now()
+		size.set(pending())
+	}
+	flushall := func() {
+		for r := range bins {
+			flush(r)
+		}
+	}
+	seqno := map[string]int64{} // with -seq, the last line's, for each endpoint a route goes to
+	pack := func(l Log) {
+		r := routeof(l)
+		if *seq {
+			to := "" // the endpoints without a route
+			if r > 0 {
+				to = rules[r-1].to
+			}
+			seqno[to]++
+			if l.R == nil || !l.has("seq") {
+				l.Set("seq", seqno[to]) // a passthrough object's own wins
+			}
+		}
+		b := &bins[r]
+		n := l.Len()
+		if m := b.size + sharedlen; n+m > batchmax() {
+			dbg("forcing flush: old=%d new=%d", n, m)
+			flush(r)
+		}
+		if len(b.Log) == 0 {
+			b.oldest = time.Now()
+		}
+		b.Log = append(b.Log, l)
+		b.size += n
+		b.newest = time.Now()
+		size.set(pending())
+		if urgent != nil && urgent.MatchString(text(l)) {
+			dbg("forcing flush: -flushon matched")
+			flush(r)
+			return
+		}
+		if *maxflush > 0 && b.size >= *flushsize && time.Since(b.flushed) >= *minflush {
+			dbg("forcing flush: size=%d", b.size)
+			flush(r)
+			return
+		}
+		if *maxlines > 0 && len(b.Log) >= *maxlines {
+			dbg("forcing flush: lines=%d", len(b.Log))
+			flush(r)
+		}
+	}
+	held := &dedup{}
+	collect := func(l Log) {
+		if *dedupe {
+			var ok bool
+			if l, ok = held.add(l); !ok {
+				return
+			}
+		}
+		pack(l)
+	}
+	release := func() {
+		if l, ok := held.release(); ok {
+			pack(l)
+		}
+	}
+	for {
+		select {
+		case t := <-tick: // prevent stale logs
+			dbg("tick: %s", t)
+			if held.expired() {
+				release()
+			}
+			for r := range bins {
+				if due(&bins[r]) {
+					flush(r)
+				}
+			}
+		case l, more := <-linec: // collect
+			if !more {
+				dbg("linec: closed")
+				release()
+				flushall()
+				return
+			}
+			collect(l)
+		}
+	}
+}
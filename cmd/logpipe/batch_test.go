@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBatch runs batch until it returns, and returns the boxes it put
+func testBatch(linec chan Log, tick chan time.Time) chan []Box {
+	boxes := []Box{}
+	done := make(chan []Box, 1)
+	go func() {
+		batch(linec, tick, *deadband, func(_ int, b Box) { boxes = append(boxes, b) })
+		done <- boxes
+	}()
+	return done
+}
+
+func TestBatch(t *testing.T) {
+	defer func(n int) { *maxlines = n }(*maxlines)
+	*maxlines = 3
+	for _, tc := range []struct {
+		name  string
+		lines int
+		boxes []int // lines in each
+	}{
+		{"none", 0, []int{}},
+		{"one", 1, []int{1}},
+		{"maxlines", 3, []int{3}},
+		{"over", 7, []int{3, 3, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			linec := make(chan Log)
+			done := testBatch(linec, nil)
+			for i := 0; i < tc.lines; i++ {
+				linec <- Log{M: "x"}
+			}
+			close(linec)
+			boxes := <-done
+			if len(boxes) != len(tc.boxes) {
+				t.Fatalf("have %d boxes, want %d", len(boxes), len(tc.boxes))
+			}
+			for i, b := range boxes {
+				if len(b.Log) != tc.boxes[i] {
+					t.Errorf("box %d: have %d lines, want %d", i, len(b.Log), tc.boxes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBatchHiwater(t *testing.T) {
+	defer func(n int) { *maxlines = n }(*maxlines)
+	*maxlines = 0
+	linec := make(chan Log)
+	done := testBatch(linec, nil)
+	line := strings.Repeat("x", 100*1024)
+	for i := 0; i < 20; i++ {
+		linec <- Log{M: line}
+	}
+	close(linec)
+	boxes := <-done
+	n := 0
+	for _, b := range boxes {
+		if b.Len() > batchmax() {
+			t.Errorf("box is %d bytes, over %d", b.Len(), batchmax())
+		}
+		n += len(b.Log)
+	}
+	if n != 20 || len(boxes) < 4 {
+		t.Errorf("have %d lines in %d boxes, want 20 lines over at least 4", n, len(boxes))
+	}
+}
+
+func TestBatchFlushOn(t *testing.T) {
+	defer func(re *regexp.Regexp) { urgent = re }(urgent)
+	urgent = regexp.MustCompile("FATAL")
+	linec := make(chan Log)
+	done := testBatch(linec, nil)
+	for _, m := range []string{"a", "b FATAL", "c", "FATAL", "d"} {
+		linec <- Log{M: m}
+	}
+	close(linec)
+	want := []int{2, 2, 1}
+	boxes := <-done
+	if len(boxes) != len(want) {
+		t.Fatalf("have %d boxes, want %d", len(boxes), len(want))
+	}
+	for i, b := range boxes {
+		if len(b.Log) != want[i] {
+			t.Errorf("box %d: have %d lines, want %d", i, len(b.Log), want[i])
+		}
+	}
+}
+
+func TestBatchTick(t *testing.T) {
+	linec, tick := make(chan Log), make(chan time.Time)
+	put := make(chan Box)
+	go batch(linec, tick, *deadband, func(_ int, b Box) { put <- b })
+	linec <- Log{M: "a"}
+	linec <- Log{M: "b"}
+	tick <- time.Now()
+	if b := <-put; len(b.Log) != 2 {
+		t.Errorf("have %d lines, want 2", len(b.Log))
+	}
+	close(linec)
+}
+
+func TestBatchIdle(t *testing.T) {
+	defer func(i, f time.Duration) { *idle, *deadband = i, f }(*idle, *deadband)
+	*idle, *deadband = 50*time.Millisecond, time.Hour
+	linec, tick := make(chan Log), make(chan time.Time)
+	put := make(chan Box, 1)
+	go batch(linec, tick, *deadband, func(_ int, b Box) { put <- b })
+	defer close(linec)
+	linec <- Log{M: "a"}
+	tick <- time.Now()
+	select {
+	case <-put:
+		t.Fatal("flushed before -idle")
+	case <-time.After(10 * time.Millisecond):
+	}
+	time.Sleep(50 * time.Millisecond)
+	tick <- time.Now()
+	if b := <-put; len(b.Log) != 1 {
+		t.Errorf("have %d lines, want 1", len(b.Log))
+	}
+}
+
+func TestBatchClose(t *testing.T) {
+	linec := make(chan Log, 10)
+	linec <- Log{M: "a"}
+	linec <- Log{M: "b"}
+	linec <- Log{M: "c"}
+	close(linec)
+	done := testBatch(linec, nil)
+	boxes := <-done
+	n := 0
+	for _, b := range boxes {
+		n += len(b.Log)
+	}
+	if n != 3 {
+		t.Errorf("have %d lines, want the 3 sent before close", n)
+	}
+}
+
+func TestBatchDedup(t *testing.T) {
+	defer func(d bool) { *dedupe = d }(*dedupe)
+	*dedupe = true
+	linec := make(chan Log)
+	done := testBatch(linec, nil)
+	for _, m := range strings.Split("a a a b a c c", " ") {
+		linec <- Log{M: m}
+	}
+	close(linec)
+	boxes := <-done
+	have := []string{}
+	for _, b := range boxes {
+		for _, l := range b.Log {
+			have = append(have, l.M+fmt.Sprint(l.A["repeated"]))
+		}
+	}
+	if want := "a3 b<nil> a<nil> c2"; strings.Join(have, " ") != want {
+		t.Errorf("have %q, want %q", strings.Join(have, " "), want)
+	}
+}
+
+func TestBatchSeq(t *testing.T) {
+	defer func(s, d bool) { *seq, *dedupe = s, d }(*seq, *dedupe)
+	*seq, *dedupe = true, true
+	linec := make(chan Log)
+	done := testBatch(linec, nil)
+	for _, m := range []string{"a", "b", "b", "b", "c"} {
+		linec <- Log{M: m}
+	}
+	close(linec)
+	have := []string{}
+	for _, b := range <-done {
+		for _, l := range b.Log {
+			have = append(have, fmt.Sprint(l.M, l.A["seq"]))
+		}
+	}
+	if fmt.Sprint(have) != "[a1 b2 c3]" {
+		t.Fatalf("have %v, want [a1 b2 c3]", have)
+	}
+
+	linec = make(chan Log)
+	done = testBatch(linec, nil)
+	linec <- Log{R: json.RawMessage(`{"msg":"hi","seq":5}`)}
+	linec <- Log{R: json.RawMessage(`{"msg":"hi"}`)}
+	close(linec)
+	have = []string{}
+	for _, b := range <-done {
+		for _, l := range b.Log {
+			raw, _ := l.raw()
+			have = append(have, string(raw))
+		}
+	}
+	if fmt.Sprint(have) != `[{"msg":"hi","seq":5} {"msg":"hi","seq":2}]` {
+		t.Fatalf("passthrough: have %v, want its own seq kept", have)
+	}
+
+	defer func(r routes) { rules = r }(rules)
+	rules = nil
+	for _, r := range []string{"to=a,match=^a", "to=a,match=^b"} {
+		if err := rules.Set(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	linec = make(chan Log)
+	done = testBatch(linec, nil)
+	for _, m := range []string{"a", "x", "b", "y", "a"} {
+		linec <- Log{M: m}
+	}
+	close(linec)
+	have = []string{}
+	for _, b := range <-done {
+		for _, l := range b.Log {
+			have = append(have, fmt.Sprint(l.M, l.A["seq"]))
+		}
+	}
+	sort.Strings(have)
+	if fmt.Sprint(have) != "[a1 a3 b2 x1 y2]" {
+		t.Fatalf("routed: have %v, want a's routes and the rest counted apart", have)
+	}
+}
+
+func TestBatchGauge(t *testing.T) {
+	inbox := func() int64 { return atomic.LoadInt64(&stats.inbox) }
+	before := inbox()
+	a, b := make(chan Log), make(chan Log)
+	adone, bdone := testBatch(a, nil), testBatch(b, nil)
+	a <- Log{M: "1"}
+	a <- Log{M: "2"}
+	b <- Log{M: "3"}
+	for end := time.Now().Add(time.Second); inbox()-before != 3 && time.Now().Before(end); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := inbox() - before; n != 3 {
+		t.Errorf("have %d lines being collected, want 3 from both collectors", n)
+	}
+	close(a)
+	close(b)
+	<-adone
+	<-bdone
+	if n := inbox() - before; n != 0 {
+		t.Errorf("have %d lines being collected after flushing, want 0", n)
+	}
+}
+
+// run with -race, the collectors set seq on lines they all got
+func TestFanout(t *testing.T) {
+	defer func(s bool, n int) { *seq, *maxlines = s, n }(*seq, *maxlines)
+	*seq, *maxlines = true, 10
+	a, b := &sink{endpoint: endpoint{url: "http://a", flush: time.Second}}, &sink{endpoint: endpoint{url: "http://b", flush: 2 * time.Second}}
+	sinks := []*sink{a, b}
+	cs := collectors(sinks, [][]*sink{sinks})
+	if len(cs) != 2 {
+		t.Fatalf("have %d collectors, want 2", len(cs))
+	}
+	boxc := make(chan Box)
+	marshaled := make(chan int)
+	go func() {
+		n := 0
+		for box := range boxc {
+			js(box) // like the pushers
+			n += len(box.Log)
+		}
+		marshaled <- n
+	}()
+	done := make(chan bool)
+	for _, c := range cs {
+		go func(c *collector) {
+			batch(c.linec, nil, c.f, func(_ int, box Box) { boxc <- box })
+			done <- true
+		}(c)
+	}
+	for i := 0; i < 100; i++ {
+		l := newLog("x", 1)
+		l.Set("i", i)
+		fanout(cs, l, func(linec chan Log, l Log) { linec <- l })
+	}
+	for _, c := range cs {
+		close(c.linec)
+	}
+	<-done
+	<-done
+	close(boxc)
+	if n := <-marshaled; n != 200 {
+		t.Errorf("have %d lines pushed, want 100 to each", n)
+	}
+}
+
+func TestEvery(t *testing.T) {
+	defer func(i, min, max time.Duration) { *idle, *minflush, *maxflush = i, min, max }(*idle, *minflush, *maxflush)
+	*minflush = 250 * time.Millisecond
+	for _, tc := range []struct {
+		f, idle, maxflush, want time.Duration
+	}{
+		{5 * time.Second, 0, 0, 5 * time.Second},
+		{5 * time.Second, 0, 10 * time.Second, 250 * time.Millisecond},
+		{5 * time.Second, 100 * time.Millisecond, 0, 50 * time.Millisecond},
+		{5 * time.Second, time.Nanosecond, 0, time.Millisecond},
+		{0, 0, 0, time.Millisecond},
+	} {
+		*idle, *maxflush = tc.idle, tc.maxflush
+		if have := every(tc.f); have != tc.want {
+			t.Errorf("every(%s) with -idle %s -maxflush %s: have %s, want %s", tc.f, tc.idle, tc.maxflush, have, tc.want)
+		}
+	}
+}
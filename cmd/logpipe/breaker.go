@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker stops pushes to an endpoint that keeps failing. after -breaker
+// failed pushes in a row it opens, and nothing is pushed for -cooldown.
+// then a single push probes the endpoint, and closes the breaker if it
+// goes through, or opens it again if not. a nil breaker never opens
+type breaker struct {
+	mu    sync.Mutex
+	ep    string
+	max   int
+	cool  time.Duration
+	fails int       // failed pushes in a row
+	until time.Time // open until then
+	probe bool      // the cooldown is over, the next push decides
+}
+
+// breaker states, as the metrics have them
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func newBreaker(ep string, max int, cool time.Duration) *breaker {
+	if max <= 0 {
+		return nil
+	}
+	return &breaker{ep: ep, max: max, cool: cool}
+}
+
+// wait returns how long the breaker stays open, or 0 if a push may go
+func (b *breaker) wait() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.until.IsZero() {
+		return 0
+	}
+	if d := time.Until(b.until); d > 0 {
+		return d
+	}
+	b.until, b.probe = time.Time{}, true
+	dbg("breaker: %s: probing", b.ep)
+	return 0
+}
+
+// probing says whether the next push is the probe, which isnt retried
+func (b *breaker) probing() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.probe
+}
+
+// record counts a push that went through, or didnt
+func (b *breaker) record(ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ok {
+		if b.probe {
+			info(map[string]any{"endpoint": b.ep, "breaker": "closed"}, "breaker: %s: closed, pushing again", b.ep)
+		}
+		b.fails, b.probe = 0, false
+		return
+	}
+	b.fails++
+	if b.probe || b.fails >= b.max {
+		b.until, b.probe = time.Now().Add(b.cool), false
+		diag("warn", map[string]any{"endpoint": b.ep, "breaker": "open", "failures": b.fails, "cooldown": b.cool.String()},
+			"breaker: %s: %d pushes failed in a row, pausing for %s", b.ep, b.fails, b.cool)
+	}
+}
+
+// state is breakerClosed, breakerOpen or breakerHalfOpen
+func (b *breaker) state() int {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.probe:
+		return breakerHalfOpen
+	case !b.until.IsZero() && time.Now().Before(b.until):
+		return breakerOpen
+	case !b.until.IsZero():
+		return breakerHalfOpen // the next push probes
+	}
+	return breakerClosed
+}
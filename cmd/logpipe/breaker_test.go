@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("ep", 2, 50*time.Millisecond)
+	step := func(what string, ok bool, state int) {
+		t.Helper()
+		b.record(ok)
+		if have := b.state(); have != state {
+			t.Fatalf("%s: state: have %d, want %d", what, have, state)
+		}
+	}
+	step("fail", false, breakerClosed)
+	step("ok", true, breakerClosed)
+	step("fail", false, breakerClosed)
+	step("fail again", false, breakerOpen)
+	if b.wait() <= 0 || b.probing() {
+		t.Fatal("open breaker let a push through")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if b.wait() != 0 || !b.probing() {
+		t.Fatal("cooled down breaker didnt probe")
+	}
+	step("failed probe", false, breakerOpen)
+	time.Sleep(60 * time.Millisecond)
+	b.wait()
+	step("probe", true, breakerClosed)
+	if b.probing() {
+		t.Fatal("closed breaker still probing")
+	}
+
+	var none *breaker
+	none.record(false)
+	if none.wait() != 0 || none.probing() || none.state() != breakerClosed {
+		t.Fatal("nil breaker opened")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// client is what push talks to newrelic with, see newClient
+var client = http.DefaultClient
+
+// newClient returns a client that goes through -proxy, or otherwise
+// whatever $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY say. https endpoints are
+// tunneled through the proxy with CONNECT, so tls is still end to end
+//
+// the client is made once and reused for every push, so it keeps a warm
+// connection to each endpoint for at least a few flushes. if one does get
+// closed, the tls session cache lets the next handshake resume instead
+// of starting over
+//
+// with -cacert, servers are verified against the certificates in that
+// file instead of the system's, for proxies with a private ca
+func newClient() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyFromEnvironment
+	if *proxy != "" {
+		u, err := url.Parse(*proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("bad -proxy: %q", *proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	tr.MaxIdleConnsPerHost = *maxidle
+	if *workers > *maxidle {
+		tr.MaxIdleConnsPerHost = *workers // one for each
+	}
+	idle := 3 * *deadband
+	for _, ep := range flags {
+		if 3*ep.flush > idle {
+			idle = 3 * ep.flush // the one flushing least often
+		}
+	}
+	if *maxflush > 0 {
+		idle = 3 * *maxflush
+	}
+	if idle > tr.IdleConnTimeout {
+		tr.IdleConnTimeout = idle
+	}
+	tr.TLSClientConfig = &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	// our own tls config turns http2 off unless asked for. with it, the
+	// flushes go over one connection, multiplexed, when newrelic offers it
+	tr.ForceAttemptHTTP2 = true
+	if *cacert != "" {
+		pem, err := os.ReadFile(*cacert)
+		if err != nil {
+			return nil, fmt.Errorf("-cacert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-cacert: no certificates in %s", *cacert)
+		}
+		tr.TLSClientConfig.RootCAs = pool
+	}
+	if *insecure {
+		warn("WARNING: -insecure: not verifying tls certificates, anyone in the middle can read the logs and the license key")
+		tr.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// sockurl is where pushes to a unix:// endpoint go, on its socket
+const sockurl = "http://unix/log/v1"
+
+// unixClient returns c, but dialing the unix socket at path for every
+// push, whatever the host, with no proxy in the way
+func unixClient(c *http.Client, path string) *http.Client {
+	tr, ok := c.Transport.(*http.Transport)
+	if !ok {
+		tr = http.DefaultTransport.(*http.Transport)
+	}
+	tr = tr.Clone()
+	tr.Proxy = nil
+	tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		d := net.Dialer{}
+		return d.DialContext(ctx, "unix", path)
+	}
+	return &http.Client{Transport: tr}
+}
+
+// conns and handshakes count new connections and full tls handshakes
+// made by traced pushes
+var conns, handshakes int64
+
+// traced returns ctx with a trace that tells -debug whether a push reused
+// a connection, and how many tls handshakes it took to get one, and what
+// protocol they settled on
+func traced(ctx context.Context, ep endpoint) context.Context {
+	if !*debug {
+		return ctx
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				dbg("push: %s: reused connection (idle %s)", ep, info.IdleTime.Round(time.Millisecond))
+				return
+			}
+			dbg("push: %s: new connection, %d so far", ep, atomic.AddInt64(&conns, 1))
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			if err != nil || cs.DidResume {
+				dbg("push: %s: tls resumed=%v err=%v", ep, cs.DidResume, err)
+				return
+			}
+			dbg("push: %s: tls handshake, %d so far, protocol %q", ep, atomic.AddInt64(&handshakes, 1), cs.NegotiatedProtocol)
+		},
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// aliases are friendlier names for flags in a -config file
+var aliases = map[string]string{
+	"flush":      "f",
+	"timeout":    "t",
+	"attributes": "attr",
+	"endpoints":  "endpoint",
+}
+
+// loadConfig sets flags from the json object in path, where each key is a
+// flag name, unless that flag was given on the command line. a list sets a
+// repeatable flag once for each value, and an object is joined into
+// k=v,k=v. attributes are different: those from the command line are
+// merged with the ones in the file, and win
+//
+//	{
+//		"flush": "10s",
+//		"endpoint": {"url": "https://log-api.eu.newrelic.com/log/v1"},
+//		"attributes": {"service": "api", "env": "prod"}
+//	}
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, raw := range m {
+		if a, ok := aliases[name]; ok {
+			name = a
+		}
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if name == "attr" {
+			if err := configattrs(raw); err != nil {
+				return fmt.Errorf("%s: attributes: %v", path, err)
+			}
+			continue
+		}
+		if set[name] {
+			continue
+		}
+		vals, err := configvalues(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		for _, v := range vals {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configvalues turns a json value into flag values
+func configvalues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		list = []json.RawMessage{raw}
+	}
+	vals := []string{}
+	for _, raw := range list {
+		var v any
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			kv := []string{}
+			for k, v := range v {
+				kv = append(kv, fmt.Sprint(k, "=", v))
+			}
+			sort.Strings(kv)
+			vals = append(vals, strings.Join(kv, ","))
+		case []any, nil:
+			return nil, fmt.Errorf("unsupported value: %s", raw)
+		default:
+			vals = append(vals, fmt.Sprint(v))
+		}
+	}
+	return vals, nil
+}
+
+// configattrs adds the attributes in raw, an object or a list of
+// key=value strings, that werent given with -attr
+func configattrs(raw json.RawMessage) error {
+	m := map[string]any{}
+	if json.Unmarshal(raw, &m) != nil {
+		vals, err := configvalues(raw)
+		if err != nil {
+			return err
+		}
+		tmp := kv{}
+		for _, v := range vals {
+			if err := tmp.Set(v); err != nil {
+				return err
+			}
+		}
+		m = tmp
+	}
+	for k, v := range m {
+		if _, ok := attrs[k]; !ok {
+			attrs[k] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"time"
+)
+
+// dedup collapses consecutive identical logs into the first of them, with
+// a repeated attribute counting how many there were, see -dedup
+type dedup struct {
+	l    Log
+	n    int       // times l was seen, zero if there is nothing held
+	seen time.Time // when l was first seen
+}
+
+// add holds l. if l is different from the log already held, or that one
+// has been held longer than -dedupwindow, it returns the old one
+func (d *dedup) add(l Log) (Log, bool) {
+	if d.n > 0 && same(d.l, l) && !d.expired() {
+		d.n++
+		return Log{}, false
+	}
+	old, ok := d.release()
+	d.l, d.n, d.seen = l, 1, time.Now()
+	return old, ok
+}
+
+// release returns the held log, if there is one, and forgets it
+func (d *dedup) release() (Log, bool) {
+	if d.n == 0 {
+		return Log{}, false
+	}
+	l := d.l
+	if d.n > 1 {
+		l.Set("repeated", d.n)
+	}
+	d.l, d.n = Log{}, 0
+	return l, true
+}
+
+func (d *dedup) expired() bool {
+	return d.n > 0 && time.Since(d.seen) >= *dedupwin
+}
+
+// same says whether a and b are the same log, apart from their timestamps
+func same(a, b Log) bool {
+	return a.M == b.M && string(a.R) == string(b.R) && reflect.DeepEqual(a.A, b.A)
+}
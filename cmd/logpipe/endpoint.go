@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const defaulturl = "https://log-api.newrelic.com/log/v1"
+
+// regions maps -region to newrelic's endpoint there
+var regions = map[string]string{
+	"US": defaulturl,
+	"EU": "https://log-api.eu.newrelic.com/log/v1",
+}
+
+// endpoint is a newrelic account logs are pushed to
+type endpoint struct {
+	url  string
+	key  string
+	name string        // for -route, may be empty
+	lim  *rate.Limiter // nil without -rps
+	sock *http.Client  // for a unix:// url, dials its socket, see unixClient
+
+	flush   time.Duration // its own -f, or 0
+	timeout time.Duration // its own -t, or 0
+}
+
+func (e endpoint) String() string { return e.url }
+
+// sink is where an endpoint's boxes wait to be pushed
+type sink struct {
+	endpoint
+	q  *queue
+	sp *spool   // nil without -spool
+	br *breaker // nil without -breaker
+
+	wal     *wal  // nil without -wal
+	unacked []Box // in it from a previous run, see catchup
+
+	replaying bool // in catchup, failed pushes are tried again
+}
+
+// endpoints is the repeatable -endpoint flag
+type endpoints []endpoint
+
+func (e *endpoints) String() string {
+	s := []string{}
+	for _, ep := range *e {
+		s = append(s, ep.url)
+	}
+	return strings.Join(s, " ")
+}
+
+func (e *endpoints) Set(s string) error {
+	ep := endpoint{}
+	for _, f := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return fmt.Errorf("want url=...,key=...,name=...,flush=...,timeout=...: %q", s)
+		}
+		switch k {
+		case "url":
+			ep.url = v
+		case "key":
+			ep.key = v
+		case "name":
+			ep.name = v
+		case "flush", "timeout":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("bad endpoint %s: %q", k, v)
+			}
+			if k == "flush" {
+				ep.flush = d
+			} else {
+				ep.timeout = d
+			}
+		default:
+			return fmt.Errorf("unknown endpoint field: %q", k)
+		}
+	}
+	if ep.url == "" {
+		return fmt.Errorf("endpoint has no url: %q", s)
+	}
+	*e = append(*e, ep)
+	return nil
+}
+
+// resolve returns the endpoints to push to. with no -endpoint flags,
+// they come from NR_URL and NR_KEY, which may be comma separated lists
+// paired up in order, and an empty url is the region's url def. a single
+// key is used for every url, and an endpoint without a key uses the first
+// one in NR_KEY, which may be empty too
+func resolve(flags endpoints, urls, keys, def string) ([]endpoint, error) {
+	ks := split(keys)
+	eps := append([]endpoint{}, flags...)
+	if len(eps) == 0 {
+		us := split(urls)
+		if len(us) > 1 && len(ks) > 1 && len(us) != len(ks) {
+			return nil, fmt.Errorf("%d urls in $NR_URL but %d keys in $NR_KEY", len(us), len(ks))
+		}
+		for i, u := range us {
+			if u == "" {
+				u = def
+			}
+			ep := endpoint{url: u, key: ks[0]}
+			if len(ks) > 1 {
+				ep.key = ks[i]
+			}
+			eps = append(eps, ep)
+		}
+	}
+	for i := range eps {
+		if eps[i].key == "" {
+			eps[i].key = ks[0]
+		}
+		if err := checkurl(eps[i].url); err != nil {
+			return nil, err
+		}
+	}
+	return eps, nil
+}
+
+// split splits a comma separated list, trimming spaces around each item
+func split(s string) []string {
+	l := strings.Split(s, ",")
+	for i := range l {
+		l[i] = strings.TrimSpace(l[i])
+	}
+	return l
+}
+
+// checkurl makes sure u is an absolute http or https url, or the socket
+// of a unix url
+func checkurl(u string) error {
+	p, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("bad endpoint url: %v", err)
+	}
+	if p.Scheme == "unix" {
+		if p.Host != "" || p.Path == "" {
+			return fmt.Errorf("bad endpoint url %q: want unix:///path/to/socket", u)
+		}
+		return nil
+	}
+	if p.Scheme != "http" && p.Scheme != "https" {
+		return fmt.Errorf("bad endpoint url %q: scheme must be http, https or unix", u)
+	}
+	if p.Host == "" {
+		return fmt.Errorf("bad endpoint url %q: no host", u)
+	}
+	return nil
+}
+
+// sockpath returns the socket a unix:// url is for, or "" if u isnt one
+func sockpath(u string) string {
+	p, err := url.Parse(u)
+	if err != nil || p.Scheme != "unix" {
+		return ""
+	}
+	return p.Path
+}
+
+// spoolfor returns the spool, or -wal, file name for ep. with more than
+// one endpoint, each gets its own, named after it
+func spoolfor(path string, ep endpoint, n int) string {
+	if n < 2 {
+		return path
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ep.url + "\x00" + ep.key))
+	return fmt.Sprintf("%s.%08x", path, h.Sum32())
+}
+
+// throttle blocks until ep is allowed another request under -rps
+func (e endpoint) throttle() {
+	if e.lim == nil {
+		return
+	}
+	if r := e.lim.Reserve(); r.Delay() > 0 {
+		dbg("push: %s: throttled for %s", e, r.Delay())
+		select {
+		case <-time.After(r.Delay()):
+		case <-quit.Done():
+		}
+	}
+}
+
+// slower halves ep's rate after newrelic says we're sending too much,
+// down to one request every 16 seconds
+func (e endpoint) slower() {
+	if e.lim == nil {
+		return
+	}
+	if l := e.lim.Limit() / 2; l >= 1.0/16 {
+		e.lim.SetLimit(l)
+		dbg("push: %s: slowing down to %.2f rps", e, l)
+	}
+}
+
+// faster brings ep's rate back up by a tenth, after a successful push,
+// until it's at -rps again
+func (e endpoint) faster() {
+	if e.lim == nil || e.lim.Limit() >= rate.Limit(*rps) {
+		return
+	}
+	l := e.lim.Limit() * 1.1
+	if l > rate.Limit(*rps) {
+		l = rate.Limit(*rps)
+	}
+	e.lim.SetLimit(l)
+}
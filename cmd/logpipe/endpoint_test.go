@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	for _, tc := range []struct {
+		urls, keys string
+		want       string
+	}{
+		{"", "k", "[{" + defaulturl + " k}]"},
+		{"", " ", "[{" + defaulturl + " }]"},
+		{" http://a ", " k ", "[{http://a k}]"},
+		{"http://a, http://b", "k", "[{http://a k} {http://b k}]"},
+		{"http://a,http://b", "j, k", "[{http://a j} {http://b k}]"},
+		{"http://a,http://b", "i,j,k", "error"},
+		{"ftp://a", "k", "error"},
+		{"unix:///run/fwd.sock", "k", "[{unix:///run/fwd.sock k}]"},
+		{"unix://run/fwd.sock", "k", "error"},
+	} {
+		eps, err := resolve(nil, tc.urls, tc.keys, defaulturl)
+		have := "error"
+		if err == nil {
+			have = "["
+			for i, ep := range eps {
+				if i > 0 {
+					have += " "
+				}
+				have += fmt.Sprintf("{%s %s}", ep.url, ep.key)
+			}
+			have += "]"
+		}
+		if have != tc.want {
+			t.Errorf("%q %q: have %s, want %s", tc.urls, tc.keys, have, tc.want)
+		}
+	}
+}
+
+func TestEndpointFlush(t *testing.T) {
+	var eps endpoints
+	for _, s := range []string{"url=http://a,flush=1s,timeout=2s", "url=http://b", "url=http://c,flush=1s"} {
+		if err := eps.Set(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	if eps[0].flush != time.Second || eps[0].timeout != 2*time.Second || eps[1].flush != 0 {
+		t.Errorf("have %+v, want flush and timeout on the first only", eps)
+	}
+	for _, s := range []string{"url=http://a,flush=x", "url=http://a,timeout=0s"} {
+		if err := eps.Set(s); err == nil {
+			t.Errorf("%s: want an error", s)
+		}
+	}
+	sinks := []*sink{}
+	for _, ep := range eps {
+		sinks = append(sinks, &sink{endpoint: ep})
+	}
+	// a route to a and b, everything else to all three
+	dest := [][]*sink{sinks, sinks[:2]}
+	cs := collectors(sinks, dest)
+	if len(cs) != 2 || cs[0].f != time.Second || cs[1].f != *deadband {
+		t.Fatalf("have %d collectors, want one for 1s and one for -f", len(cs))
+	}
+	if len(cs[0].dest[0]) != 2 || len(cs[0].dest[1]) != 1 || len(cs[1].dest[0]) != 1 || cs[1].dest[1][0] != sinks[1] {
+		t.Errorf("have %v and %v, want a and c on 1s, b on -f", cs[0].dest, cs[1].dest)
+	}
+	if !cs[0].emit[0] || !cs[0].emit[1] || cs[1].emit[0] || cs[1].emit[1] {
+		t.Errorf("have emit %v and %v, want each route emitted by the 1s collector only", cs[0].emit, cs[1].emit)
+	}
+	// a route to b alone is emitted by the -f collector
+	cs = collectors(sinks, [][]*sink{sinks, sinks[1:2]})
+	if !cs[0].emit[0] || cs[0].emit[1] || !cs[1].emit[1] {
+		t.Errorf("have emit %v and %v, want the route to b emitted on -f", cs[0].emit, cs[1].emit)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// redacted replaces whatever a -redact pattern matches
+const redacted = "[redacted]"
+
+// regexps is the repeatable -redact flag
+type regexps []*regexp.Regexp
+
+func (r *regexps) String() string {
+	s := []string{}
+	for _, re := range *r {
+		s = append(s, re.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (r *regexps) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// filter is a -filter command. it is given lines on its standard input
+// and must write each one back, changed or not, on its standard output
+type filter struct {
+	cmd *exec.Cmd
+	w   *bufio.Writer
+	r   *bufio.Reader
+}
+
+func startFilter(command string) (*filter, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &filter{cmd: cmd, w: bufio.NewWriter(w), r: bufio.NewReader(r)}, nil
+}
+
+// apply sends line through the filter and returns what came back
+func (f *filter) apply(line []byte) ([]byte, error) {
+	f.w.Write(line)
+	f.w.WriteByte('\n')
+	if err := f.w.Flush(); err != nil {
+		return nil, fmt.Errorf("filter: %v", err)
+	}
+	out, err := f.r.ReadBytes('\n')
+	if err == io.EOF {
+		err = fmt.Errorf("filter: exited")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+// ansi matches terminal escape sequences: CSI ones like colors, OSC ones
+// like window titles and links, and the two byte ones, see -stripansi
+var ansi = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// transform strips escapes with -stripansi, applies the -redact patterns
+// and then the -filter to a line read from the input. it returns nil if
+// the line should be dropped
+func transform(line []byte) ([]byte, error) {
+	if *stripansi {
+		line = ansi.ReplaceAllLiteral(line, nil)
+	}
+	for _, re := range redact {
+		line = re.ReplaceAllLiteral(line, []byte(redacted))
+	}
+	if filt == nil {
+		return line, nil
+	}
+	out, err := filt.apply(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		dbg("filter: dropped %q", line)
+		return nil, nil
+	}
+	return out, nil
+}
+
+// sampled says whether to keep line under -sample. with -samplehash the
+// choice is made from a hash of the line, so the same line is always kept,
+// or never is, even across restarts
+func sampled(line []byte) bool {
+	if *sample >= 1 {
+		return true
+	}
+	if *samplehash {
+		h := fnv.New32a()
+		h.Write(line)
+		return float64(h.Sum32()) < *sample*(1<<32)
+	}
+	return rand.Float64() < *sample
+}
+
+// mergewait is how long a -multiline entry is held waiting for another
+// continuation line before it's sent anyway
+const mergewait = time.Second
+
+// merger joins continuation lines, the ones -multiline matches, onto the
+// line before them, so a stack trace is sent as one log
+type merger struct {
+	re   *regexp.Regexp
+	max  int    // bytes an entry grows to before it's cut, 0 is unlimited
+	held []byte // the entry being continued, nil if none
+}
+
+// add returns the entry raw ends, if it isnt a continuation of it
+func (m *merger) add(raw []byte) []byte {
+	if m.held != nil && m.re.Match(raw) && (m.max <= 0 || len(m.held)+1+len(raw) <= m.max) {
+		m.held = append(append(m.held, '\n'), raw...)
+		return nil
+	}
+	e := m.held
+	m.held = raw
+	return e
+}
+
+// flush returns the entry being held, if any, and forgets it
+func (m *merger) flush() []byte {
+	e := m.held
+	m.held = nil
+	return e
+}
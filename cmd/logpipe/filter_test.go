@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestSampled(t *testing.T) {
+	defer func(f float64, h bool) { *sample, *samplehash = f, h }(*sample, *samplehash)
+	for _, hash := range []bool{false, true} {
+		*sample, *samplehash = 0.1, hash
+		n := 0
+		for i := 0; i < 10000; i++ {
+			line := []byte(fmt.Sprint("line ", i))
+			if sampled(line) {
+				n++
+			}
+			if hash && sampled(line) != sampled(line) {
+				t.Fatalf("%s: sampled differently", line)
+			}
+		}
+		if n < 800 || n > 1200 {
+			t.Errorf("hash=%v: kept %d of 10000, want about 1000", hash, n)
+		}
+	}
+}
+
+func TestMerger(t *testing.T) {
+	m := &merger{re: regexp.MustCompile(`^\s`), max: 27}
+	var got []string
+	for _, l := range []string{
+		"  orphan",
+		"panic: boom",
+		"\tat a()",
+		"\tat b()",
+		"next",
+		"\ttoo long for the entry",
+		"last",
+	} {
+		if e := m.add([]byte(l)); e != nil {
+			got = append(got, string(e))
+		}
+	}
+	if e := m.flush(); e != nil {
+		got = append(got, string(e))
+	}
+	want := []string{
+		"  orphan",
+		"panic: boom\n\tat a()\n\tat b()",
+		"next",
+		"\ttoo long for the entry",
+		"last",
+	}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Fatalf("have %q\nwant %q", got, want)
+	}
+	if m.flush() != nil {
+		t.Fatal("flushed twice")
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	defer func(s bool) { *stripansi = s }(*stripansi)
+	*stripansi = true
+	for _, tc := range []struct{ line, want string }{
+		{"plain", "plain"},
+		{"\x1b[31mred\x1b[0m", "red"},
+		{"\x1b[1;32;40mbold\x1b[K", "bold"},
+		{"\x1b]0;title\x07text", "text"},
+		{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"a\x1bMb", "ab"},
+	} {
+		have, _ := transform([]byte(tc.line))
+		if string(have) != tc.want {
+			t.Errorf("%q: have %q, want %q", tc.line, have, tc.want)
+		}
+	}
+}
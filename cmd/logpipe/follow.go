@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// poll is how often a followed file is checked for more data
+const poll = 250 * time.Millisecond
+
+// follower reads a file like tail -F. at the end of the file it waits for
+// more to be written, and starts over when the file is replaced by log
+// rotation or truncated. it never returns io.EOF
+type follower struct {
+	path string
+	f    *os.File
+	gone bool // the path is missing, we said so already
+}
+
+// follow opens path and seeks to its end, only new lines are read. files
+// that replace it are read from the start
+func follow(path string) (*follower, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &follower{path: path, f: f}, nil
+}
+
+func (r *follower) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if !r.rotated() {
+			time.Sleep(poll)
+		}
+	}
+}
+
+// rotated checks whether the file at path is not the one we have open
+// anymore, or was truncated, and if so starts reading it from the top
+func (r *follower) rotated() bool {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		// moved away, and the new one isnt there yet
+		if !r.gone {
+			dbg("follow: %s: %v", r.path, err)
+			r.gone = true
+		}
+		return false
+	}
+	r.gone = false
+	cur, err := r.f.Stat()
+	if err != nil || !os.SameFile(fi, cur) {
+		f, err := os.Open(r.path)
+		if err != nil {
+			return false
+		}
+		dbg("follow: %s: reopened", r.path)
+		r.f.Close()
+		r.f = f
+		return true
+	}
+	if off, err := r.f.Seek(0, io.SeekCurrent); err == nil && cur.Size() < off {
+		dbg("follow: %s: truncated", r.path)
+		r.f.Seek(0, io.SeekStart)
+		return true
+	}
+	return false
+}
@@ -2,171 +2,1820 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/time/rate"
+)
+
+const man = `
+NAME
+	logpipe - pipe logs to newrelic
+
+SYNOPSIS
+	export NR_KEY=""
+	export NR_URL="" # optional
+	export NR_REGION="" # optional, US or EU
+	echo hi newrelic | logpipe 
+	app 2>&1 | logpipe -endpoint url=...,key=... -endpoint url=...
+	app 2>&1 | logpipe [-f flushdur] [-t httptimeout] [-debug]
+	logpipe [flags] [file ...]
+	logpipe -validate # push one log to check the key, and exit
+	logpipe -health -metrics :9090 # ask a running logpipe, and exit
+	logpipe -once backup finished # push one log, and exit
+	logpipe -version
+
+DESCRIPTION
+	Logpipe sends every line read from its standard input, or the
+	named file, to newrelic as a log line. A regular file is read until
+	its end. A named pipe is read until its writers close it. If the
+	input ends in the middle of a line, say because the app writing
+	it crashed, that partial line is sent too, unless -nopartial.
+	With -gzipin, the input is decompressed first, as zcat would.
+	Given more than one file, logpipe reads them one after the other
+	as if they were one file, to backfill from rotated archives, say
+	logpipe -gzipin app.log.3.gz app.log.2.gz app.log.1.gz.
+
+	With -delim, lines end in that byte instead of a newline, for
+	input framed with NULs, say, like find -print0 writes, or with
+	-delim '\x1e' record separators. It is one byte, or an escape
+	like \0, \t or \x1e. A line may then have newlines in it, and
+	they are sent as they are, but a -filter would see them as line
+	ends too.
+
+	With -F, the file is followed like tail -F: logpipe starts at its
+	end and waits for more lines, and reopens it when it is rotated
+	or truncated.
+
+	If the log line is a json object, its fields are sent as
+	attributes, and its "message" or "msg" field as the message. A
+	"ts" field at its top level is used as the newrelic timestamp.
+	Use -tsfield and -msgfield to look for different fields, and a
+	dotted -tsfield, like meta.time, for one in a nested object. With
+	-rawjson, the whole line is sent as the message instead, like any
+	other line. With -keepraw, the line is sent too, as it was read, in
+	a raw attribute, cut to -maxmsg like the message.
+
+	The timestamp may be an RFC3339 string or a number of seconds,
+	milliseconds, microseconds or nanoseconds since the epoch. The
+	unit is guessed from the magnitude of the number, see -tsunit.
+	A line without one, or with 0, is sent with the time it was read,
+	and so, with -tsclamp, is one whose timestamp is further than
+	that from it, like a year off, from a producer with a bad clock.
+	A -passthrough line's own timestamp field is sent as it is.
+
+	With -logfmt, lines made of key=value pairs have each pair sent
+	as an attribute, and the whole line as the message. The -tsfield
+	key sets the timestamp, and lvl or severity are sent as level.
+	Lines that arent logfmt are sent as they are.
+
+	With -skipblank, empty lines, and lines with only spaces in them,
+	arent sent. They are still echoed, and counted in -stats.
+
+	With -sample, only that fraction of lines are sent, picked at
+	random, or by their content with -samplehash, so that the same
+	line is always sent, or never is. Every line is still echoed.
+
+	With -dedup, a line repeated over and over, like syslog's
+	"message repeated N times", is sent once, with a repeated
+	attribute counting how many times it was seen in a row. It is
+	sent when a different line arrives, or after -dedupwindow.
+
+	With -ratekey, each value of that attribute, say each service,
+	may send -ratelimit lines in a window, like 100/1s, and its lines
+	past that are dropped, so one noisy service cant crowd out the
+	rest. The budget refills steadily over the window, and can be
+	spent all at once. Lines without the attribute share one budget.
+	The dropped lines are still echoed, and counted for each value
+	in -stats and -metrics.
+
+	With -multiline, lines matching its regexp continue the line
+	before them, and are joined onto it, after -redact and -filter,
+	so a stack trace is sent as a single log. For example, for java:
+
+	logpipe -multiline '^\s+(at |\.\.\.)|^Caused by:'
+
+	or for python, -multiline '^(\s|\w+(Error|Exception):)'. An
+	entry is sent once a line that doesnt continue it arrives, or a
+	second after its last line.
+
+	With -seq, each log has a seq attribute numbering the lines in
+	the order they were collected, to put them back in order when
+	their timestamps tie, or to see which never arrived. It starts
+	over at 1 every time logpipe does. Each endpoint a -route goes
+	to has its own count, and the others share one. Lines that
+	-sample, -filter, -dedup, -ratekey or -drop leave out, or that
+	go to other endpoints, are never numbered, so they leave no gap.
+
+	Before anything else, each line has its terminal escapes, like
+	colors, removed with -stripansi, what the -redact patterns match
+	replaced, and is passed through the -filter command. The
+	filter is started once, and must write back a line for each line
+	it is given, without buffering them (e.g. sed -u). If it writes
+	back an empty line, the line is dropped.
+
+	With -passthrough, a line that is a json object is already a log,
+	and is sent as it is, with a timestamp added if it has none. Other
+	lines are sent as messages, or dropped with -strict.
+
+	With -level, each log gets a level attribute taken from the level
+	field of a json line, or the first of FATAL, ERROR, WARN, INFO,
+	DEBUG or TRACE found in the line. See also -levelregex.
+
+	With -traceregex, the trace_id and span_id groups of its regexp
+	become the trace.id and span.id attributes newrelic links a log
+	to its trace by, for logs in context. For example:
+
+	logpipe -traceregex 'trace_id=(?P<trace_id>[0-9a-f]+) span_id=(?P<span_id>[0-9a-f]+)'
+
+	A line that doesnt match gets neither, and a json line that has
+	its own trace.id or span.id keeps it.
+
+	By default, each line read is re-emitted to standard output, as
+	it was read. With -echo transformed, it is echoed as it is sent
+	instead, after -stripansi, -redact and -filter, and not at all if
+	the filter drops it, so what comes out can be piped on to a
+	consumer that shouldnt see secrets or colors. -echo off, or -q,
+	echoes nothing. What is echoed is buffered, and written out
+	every -f, or as boxes are flushed, unless -flushstdout writes
+	each line as soon as it is read. With -emit payload, what is
+	sent to newrelic is written there instead, one json payload per
+	line, as each box is flushed.
+
+	Every log has the hostname and the pid of logpipe as attributes,
+	unless -nohost is set, along with any -attr given, and the
+	environment variables named by -envattr. These are sent once
+	per request, in the common block of newrelic's detailed format,
+	unless -nocommon. A log's own attributes win over them.
+
+	With -logtype, every log has that logtype attribute, which
+	newrelic parses it by with one of its built-in rules, like nginx,
+	apache or syslog-rfc5424, or one of your own. It is the same as
+	-attr logtype=..., and wins over that.
+
+	Logpipe will automatically batch log lines. See FLAGS. A box is
+	flushed early once it has -maxlines lines, or about -maxbatch
+	bytes, which is just under newrelic's 1MiB limit. Other endpoints
+	may take more, or less.
+
+	The box of lines is flushed every -f. With -maxflush, it is
+	flushed as soon as it reaches -flushsize instead, but no more
+	than once every -minflush, and a smaller box waits for up to
+	-maxflush. Quiet inputs make fewer requests, and bursts arent
+	held up.
+
+	With -idle, a box is also flushed as soon as no line has arrived
+	for that long, so the last lines before an app goes quiet arent
+	held up. Then -f is how long the first line of a box waits at
+	most, instead of a clock every box is flushed on.
+
+	With -flushon, a line matching its regexp flushes its box right
+	away, with the lines before it, so that, say, -flushon 'FATAL|panic:'
+	gets a crash to newrelic before the app is gone. It sees the line
+	as it is sent, after -redact, -filter and -multiline.
+
+	When many logpipes start at once, say across a fleet, -jitter
+	spreads their flushes out, instead of all of them pushing in the
+	same instant every -f.
+
+	With -align, the flushes happen on the clock instead, at whole
+	multiples of -f, so with -f 10s on the :00, :10, :20 seconds and
+	so on, wherever and whenever logpipe started. Every logpipe in a
+	fleet then flushes in the same instant, the opposite of -jitter.
+	A box that fills up is still flushed early.
+
+	Set at least NR_KEY to your newrelic license key and run
+	the examples as above. To keep it out of the environment, put
+	it in a file instead and use -keyfile. If your account is in the
+	EU, set $NR_REGION to EU, or use -region. $NR_URL wins over both.
+
+	In the cloud, -keysource fetches the key once at startup from a
+	secret manager instead, aws-sm://name from aws's, with the aws
+	cli, or gcp-sm://project/name from google's, with gcloud. The
+	cli has to be installed and on $PATH, logpipe doesnt include
+	either sdk. They use whatever credentials they have. The secret
+	is the key, or a json object with a key, and maybe a url used if
+	$NR_URL isnt set.
+
+	With -debug, logpipe starts by printing the endpoints, and the
+	length and last four characters of their keys, the flush and
+	timeout, and the flags that were set, to see what it made of
+	them.
+
+	To send every log to more than one account, set $NR_URL and
+	$NR_KEY to comma separated lists, or repeat -endpoint. A failing
+	endpoint doesnt hold up the others.
+
+	An -endpoint may have its own flush=, instead of -f, and its own
+	timeout=, instead of -t, so that one route is flushed every
+	second while an archive gets a box every minute:
+
+	logpipe -endpoint url=...,key=...,name=alerts,flush=1s \
+		-endpoint url=...,key=...,flush=1m,timeout=30s
+
+	Endpoints that flush at different times each collect their own
+	boxes, from every line, so each holds its own copy of them.
+
+	A url like unix:///run/forwarder.sock pushes to a local forwarder
+	listening on that unix socket instead, as http posts to /log/v1,
+	the same as newrelic would get them.
+
+	Other services that take logs as json over http, like Loki or
+	Vector, may want them wrapped differently, see -wrap and
+	-contenttype.
+
+	To route lines instead, name the endpoints and give each route
+	the levels, or a regexp for the message, it takes. Levels need
+	-level, which a route with one implies. A line goes down the
+	first route it matches, to that endpoint only, and the endpoints
+	without a route get the lines that match none. For example:
+
+	logpipe -endpoint url=...,key=...,name=audit \
+		-endpoint url=...,key=... \
+		-route to=audit,level=error|fatal
+
+	On SIGINT or SIGTERM, logpipe stops reading, flushes what it
+	has buffered and exits. A second signal exits immediately. Either
+	way, once out of input, logpipe spends at most -shutdown pushing
+	what is left. Boxes that dont make it are spooled, or dropped.
+	With -maxlife, logpipe stops, flushes and exits the same way
+	after running that long, with status 0, so a supervisor starts
+	a fresh one, with whatever config it has now.
+	On SIGUSR1, logpipe prints what it is doing to stderr and carries
+	on: lines read, what is being collected and queued, and how the
+	last push went.
+
+	Boxes are pushed to each endpoint one at a time, or -workers at
+	a time, each on its own connection, for when the round trip to
+	newrelic is what holds logpipe up. They may arrive out of order
+	then, newrelic orders logs by their timestamp anyway. Where the
+	endpoint speaks http2, they share one connection instead, and
+	-debug says which protocol each push went over.
+
+	A failed push is retried with exponential backoff (see -retries
+	and -maxbackoff). Reading continues while the push is retried.
+	With -spool, a box that still fails is appended to the spool file.
+	Spooled boxes are pushed before anything else, starting with
+	any left over from a previous run. When that fails, the spool
+	isnt replayed again until a backoff like the retries' is up, and
+	new boxes are appended to it meanwhile.
+	Without a spool, -fallback writes the lines of such a box to a
+	file, or stderr, as json, one per line, instead of dropping them,
+	so they can be recovered from the supervisor's logs, say. That
+	includes whatever is left when -shutdown runs out. Nothing is
+	pushed from there, but logpipe -passthrough could.
+
+	Only errors that may go away are retried: timeouts, 429s and 5xx.
+	A box newrelic says is too large (413) is split in two and each
+	half pushed again, other 4xx boxes are dropped with a warning.
+
+	If logpipe falls behind, up to -qlen lines are read ahead, then
+	reading blocks, and so does whatever is writing to logpipe. A
+	warning is printed when that happens. With -drop, lines are
+	dropped instead, for apps that would rather lose logs than stall.
+
+	With -breaker, an endpoint that fails that many pushes in a row
+	isnt pushed to for -cooldown. Its boxes are spooled meanwhile, or
+	wait in memory. Then one push, without retries, checks whether it
+	is back, and if not, it waits another -cooldown.
+
+	While an endpoint is down, boxes wait in memory for it, up to
+	-maxbuffer bytes of them. The endpoints share the boxes, unless
+	they flush at different times, so that is about all the memory
+	they use. What happens once they fill it is up to -overflow.
+	With block, reading blocks until a push makes room, and nothing
+	is lost. With ring, the oldest boxes are dropped to make room
+	for new ones, like a ring buffer. With spool, they are spooled,
+	oldest first, see DELIVERY.
+
+	With -overflow ring, an outage that outlasts -maxbuffer loses the
+	oldest lines, for good, even with -wal, and keeps the freshest,
+	which are what matter once it's over. The boxes and lines dropped
+	are counted in -stats and -metrics, and a warning says when it
+	starts. By default it is spool with -spool, ring with -drop, and
+	otherwise block. With both -spool and -drop, boxes the spool
+	cant take are dropped too.
+
+	With -metrics, logpipe serves prometheus metrics over http. For
+	a liveness probe, logpipe -health -metrics with the same addr asks
+	a running logpipe how it is doing, and exits 1 if nothing it
+	had waiting was pushed in the last -healthage, or it holds
+	-maxbuffer bytes.
+
+	Each push has a random uuid in its X-Request-Id header, or the
+	-requestid header, and a push that fails says which it had, to
+	find it in the logs of a proxy, or whatever is in between.
+
+	The User-Agent is logpipe/ and the version, which -version prints
+	with the commit and build date. They come from go install, or go
+	build in a checkout, or are set when building with
+	-ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+
+CONFIG
+	With -config, flags are read from a json object keyed by flag
+	name, or flush, timeout, endpoint and attributes. Flags given on
+	the command line win. Attributes from both are merged.
+
+	{
+		"flush": "10s",
+		"timeout": "5s",
+		"endpoint": {"url": "https://log-api.eu.newrelic.com/log/v1"},
+		"attributes": {"service": "api", "env": "prod"}
+	}
+
+TEMPLATES
+	With -template, each payload is made with a go text/template,
+	for services that want logs in a shape -wrap doesnt have. It is
+	given .Logs, each one a map with the message, timestamp and
+	attributes, and .Common, the attributes every log has. The json
+	function quotes a value as json. For example:
+
+	logpipe -contenttype application/json -template \
+		'{"events":[{{range $i, $l := .Logs}}{{if $i}},{{end}}{{json $l.message}}{{end}}]}'
+
+	The payload is made before it is gzipped, as usual.
+
+DELIVERY
+	By default, delivery is at most once: a box that cant be pushed
+	is spooled with -spool, or dropped, and whatever logpipe holds in
+	memory is lost if it is killed.
+
+	With -wal, delivery is at least once. Each box is written to the
+	wal file, and synced to disk, before it is pushed, and acked there
+	once newrelic accepts it, refuses it for good, or it is spooled.
+	When logpipe starts, the boxes in the wal that were never acked,
+	say because it was killed, are pushed again before anything new,
+	so newrelic may get some logs twice. A box that fails every retry
+	and isnt spooled stays in the wal too, until the next start. With
+	-overflow ring, boxes dropped from a full -maxbuffer are acked,
+	and lost.
+	Lines read but not yet in a box are not in the wal, see -f.
+
+	On start, what a previous run left, the spool and then the boxes
+	the wal never acked, is pushed before anything new. While the
+	endpoint is down, each push is retried like any other, and then
+	the whole replay again, backing off up to -maxbackoff, until it
+	goes through, or -shutdown runs out once the input ends. Lines
+	are read and collected meanwhile, and wait behind it in
+	-maxbuffer, or in the spool after the rest.
+
+	With more than one endpoint, each gets its own wal, and its own
+	spool, named after it.
+
+	With -spool, an endpoint that cant keep up doesnt stop reading
+	once -maxbuffer is full. The boxes waiting for it are spooled,
+	oldest first, and then each new one, until a push goes through.
+	Then the spool is replayed, in order, before the boxes that came
+	after it. So boxes arrive in the order they were collected,
+	except for the ones being pushed when spooling started, which
+	are spooled after the rest if they fail too, and, with -workers,
+	those pushed at the same time.
+
+	A box too big for one push is split, and its parts may not all
+	end up the same way. With -debug, each box says how many of its
+	lines were pushed, spooled or kept for later, and dropped, and
+	-stats and -metrics count them.
+
+BUGS
+	(1) If push fails after all retries, and there is no -spool,
+	the buffered log lines are lost, unless -fallback
+
+FLAGS`
+
+var (
+	config      = flag.String("config", "", "read flags from this json `file`, see CONFIG")
+	deadband    = flag.Duration("f", 5*time.Second, "flush logs after this duration")
+	minflush    = flag.Duration("minflush", 250*time.Millisecond, "with -maxflush, flush at most this often")
+	maxflush    = flag.Duration("maxflush", 0, "flush adaptively, holding a small box for up to this long, see -flushsize")
+	flushsize   = flag.Int("flushsize", 64*1024, "with -maxflush, flush once a box has this many bytes")
+	idle        = flag.Duration("idle", 0, "also flush once no line has arrived for this long, and make -f how long the first line in a box waits at most")
+	jitter      = flag.Float64("jitter", 0, "start flushing at a random point in this `fraction` of the first -f, so a fleet started together doesnt flush in lockstep")
+	align       = flag.Bool("align", false, "flush on the clock, at multiples of -f, e.g. on the :00, :10, :20 seconds with -f 10s")
+	timeout     = flag.Duration("t", 5*time.Second, "http timeout")
+	debug       = flag.Bool("debug", false, "debug output to stderr")
+	logjson     = flag.Bool("logjson", false, "write logpipe's own messages to stderr as json objects, including retries")
+	quiet       = flag.Bool("q", false, "same as -echo off")
+	flushstdout = flag.Bool("flushstdout", false, "write each line echoed to stdout right away, instead of with each flush")
+	echo        = flag.String("echo", "raw", "echo each line to stdout as it was read, `raw`, as it is sent, transformed, or off")
+	emit        = flag.String("emit", "line", "what to write to stdout: each `line` read, or each payload sent")
+	gzipin      = flag.Bool("gzipin", false, "the input is gzipped")
+	inpath      = flag.String("in", "", "read from this file or named pipe instead of stdin, same as the file argument")
+	nopartial   = flag.Bool("nopartial", false, "drop a last line that doesnt end in a newline")
+	delimiter   = flag.String("delim", "", "lines end in this `byte`, or escape like \\0 or \\x1e, instead of a newline")
+	tail        = flag.Bool("F", false, "follow the input file as it grows and is rotated")
+	oneshot     = flag.Bool("once", false, "push the arguments as a single log, instead of reading any input, and exit")
+	validate    = flag.Bool("validate", false, "push one log to check the endpoints and keys work, print OK or why not, and exit")
+	dryrun      = flag.Bool("dryrun", false, "print each payload to stderr instead of sending it, no key needed")
+	region      = flag.String("region", "", "push to newrelic's US or EU endpoint, overrides $NR_REGION")
+	proxy       = flag.String("proxy", "", "proxy url, overrides $HTTPS_PROXY and $HTTP_PROXY")
+	cacert      = flag.String("cacert", "", "verify servers with the ca certificates in this pem `file`, instead of the system's")
+	insecure    = flag.Bool("insecure", false, "dont verify tls certificates at all, for testing only")
+	rps         = flag.Float64("rps", 0, "push at most this many requests per second to each endpoint, 0 is unlimited")
+	maxidle     = flag.Int("maxidle", 4, "idle connections to keep open to each endpoint")
+	workers     = flag.Int("workers", 1, "push this many boxes to each endpoint at once, in no particular order")
+	keyfile     = flag.String("keyfile", "", "read the license key from this file if $NR_KEY is unset")
+	keysource   = flag.String("keysource", "", "fetch the license key from this `secret`, aws-sm://name or gcp-sm://project/name, instead of $NR_KEY, with the aws or gcloud cli, which must be on $PATH")
+	useragent   = flag.String("useragent", "logpipe/"+release(), "User-Agent header sent with each push")
+	requestid   = flag.String("requestid", "X-Request-Id", "send a random id with each push in this `header`, and say which it was when one fails, empty sends none")
+	showversion = flag.Bool("version", false, "print the version, commit and build date, and exit")
+	authhdr     = flag.String("authheader", "Api-Key", "header carrying the license key")
+	authpfx     = flag.String("authprefix", "", "auth scheme to put before the license key, e.g. Bearer")
+	maxline     = flag.Int("maxline", maxplain, "longest line that can be read, in bytes")
+	maxmsg      = flag.Int("maxmsg", 0, "cut messages longer than this many bytes, saying how much was cut, 0 is no limit")
+	maxlines    = flag.Int("maxlines", 1000, "flush once a box has this many lines")
+	flushon     = flag.String("flushon", "", "flush a box at once when a line in it matches this `regexp`")
+	maxbatch    = flag.Int("maxbatch", hiwater, "flush once a box has about this many `bytes`, before compression, for endpoints with other limits")
+	retries     = flag.Int("retries", 3, "retry a failed push this many times before dropping it")
+	maxlife     = flag.Duration("maxlife", 0, "flush and exit after running this long, for a supervisor to start it again, 0 runs until the input ends")
+	shutdown    = flag.Duration("shutdown", 30*time.Second, "on exit, give up pushing after this long, 0 waits forever")
+	maxback     = flag.Duration("maxbackoff", 30*time.Second, "maximum delay between retries")
+	wrap        = flag.String("wrap", "array", "send each box in an array like newrelic wants, as a bare object, or as ndjson, one log per line")
+	ctype       = flag.String("contenttype", "", "Content-Type of the payload, by default application/json, or application/x-ndjson with -wrap ndjson")
+	tmpltext    = flag.String("template", "", "make each payload with this go `template`, or the file named after an @, instead of -wrap, see TEMPLATES")
+	gz          = flag.Bool("gzip", false, "gzip the payload, this batches more lines per request")
+	tsfield     = flag.String("tsfield", "ts", "json field holding the timestamp, a dotted path like meta.time for a nested one")
+	msgfield    = flag.String("msgfield", "message", "top level json field holding the message, message also looks for msg")
+	tsunit      = flag.String("tsunit", "auto", "unit of numeric timestamps: s, ms, us, ns or auto")
+	tsclamp     = flag.Duration("tsclamp", 0, "send the time a line was read instead of its timestamp, if that is further than this from it, e.g. 24h, 0 trusts any")
+	metricsaddr = flag.String("metrics", "", "serve prometheus metrics on this `addr`, e.g. :9090")
+	stall       = flag.Duration("stall", 0, "warn when boxes are waiting and nothing has been pushed for this long, 0 never warns")
+	checkhealth = flag.Bool("health", false, "ask the logpipe serving -metrics whether it's healthy, print OK or why not, and exit")
+	healthage   = flag.Duration("healthage", 2*time.Minute, "with -health, unhealthy if lines have waited this long without a successful push")
+	showstats   = flag.Bool("stats", false, "print a summary of what was sent to stderr on exit")
+	prefix      = flag.String("prefix", "", "put this `tag` and a space before each message")
+	nocommon    = flag.Bool("nocommon", false, "repeat the attributes in every log, instead of once per request")
+	nohost      = flag.Bool("nohost", false, "dont add the hostname and pid attributes")
+	logtype     = flag.String("logtype", "", "set the logtype attribute newrelic picks a parsing rule by, e.g. nginx or apache")
+	envattr     = flag.String("envattr", "", "add these comma separated `vars` from the environment as attributes, skipping unset ones, e.g. BUILD_SHA,APP_VERSION")
+	sample      = flag.Float64("sample", 1, "send only this `fraction` of lines, chosen at random, they are all still echoed")
+	samplehash  = flag.Bool("samplehash", false, "with -sample, choose lines by a hash of their content instead")
+	dedupe      = flag.Bool("dedup", false, "collapse repeats of a line into one log, with a repeated attribute counting them")
+	dedupwin    = flag.Duration("dedupwindow", 10*time.Second, "with -dedup, send a repeated line at least this often")
+	ratekey     = flag.String("ratekey", "", "limit the lines sent for each value of this `attribute`, e.g. service, to -ratelimit")
+	ratelimit   = flag.String("ratelimit", "1000/1s", "with -ratekey, send at most this many `lines/window` for each value, dropping the rest")
+	seq         = flag.Bool("seq", false, "number the lines collected in a seq attribute, starting from 1 each run")
+	skipblank   = flag.Bool("skipblank", false, "dont send empty lines, or lines of only spaces")
+	stripansi   = flag.Bool("stripansi", false, "remove terminal escapes, like colors, from each line before its sent, it's still echoed with them")
+	filtercmd   = flag.String("filter", "", "pipe each line through this shell `command`, which answers each line with one line, empty to drop it")
+	rawjson     = flag.Bool("rawjson", false, "send json lines as the message, instead of their fields as attributes")
+	keepraw     = flag.Bool("keepraw", false, "send json lines in a raw attribute too, as they were read")
+	passthrough = flag.Bool("passthrough", false, "send json object lines as they are, instead of as a message")
+	strict      = flag.Bool("strict", false, "with -passthrough, drop lines that arent json objects")
+	levels      = flag.Bool("level", false, "set a level attribute from a json level field, or words like ERROR and WARN in the line")
+	traceregex  = flag.String("traceregex", "", "set trace.id and span.id from this `regexp`'s trace_id and span_id groups, for logs in context")
+	levelregex  = flag.String("levelregex", "", "find the level with this `regexp` instead, its first group is the level, implies -level")
+	logfmt      = flag.Bool("logfmt", false, "parse key=value lines into attributes")
+	multiline   = flag.String("multiline", "", "join lines matching this `regexp`, e.g. '^\\s', onto the line before them, as one log")
+	spoolpath   = flag.String("spool", "", "append boxes that fail to push to this file, and replay them later")
+	walpath     = flag.String("wal", "", "log boxes to this `file` before pushing them, and push those never acked again on restart, see DELIVERY")
+	fallbackto  = flag.String("fallback", "", "without -spool, write the lines of boxes that still fail to push to this `file`, - is stderr, instead of dropping them")
+	qlen        = flag.Int("qlen", 256, "lines read ahead of the collector before reading blocks")
+	drop        = flag.Bool("drop", false, "drop lines instead of blocking once -qlen lines are read ahead, or -maxbuffer is full")
+	maxbuffer   = flag.Int("maxbuffer", 256<<20, "hold at most this many `bytes` of boxes for each endpoint, queued or being pushed, 0 is unlimited")
+	overflow    = flag.String("overflow", "", "once -maxbuffer is full, `block` reading, ring to drop the oldest boxes, or spool them, by default spool with -spool, ring with -drop")
+	trip        = flag.Int("breaker", 0, "stop pushing to an endpoint for -cooldown after this many failed pushes in a row, 0 never stops")
+	cooldown    = flag.Duration("cooldown", 30*time.Second, "with -breaker, how long to stop pushing before trying again")
+
+	attrs  = kv{}
+	flags  endpoints
+	rules  routes
+	redact regexps
+	filt   *filter        // nil without -filter
+	multi  *merger        // nil without -multiline
+	urgent *regexp.Regexp // nil without -flushon
+	keylim *limiter       // nil without -ratekey
+
+	// a stray space in either would only fail once we push
+	key = strings.TrimSpace(os.Getenv("NR_KEY"))
+	uri = strings.TrimSpace(os.Getenv("NR_URL"))
 )
 
-const man = `
-NAME
-	logpipe - pipe logs to newrelic
+func init() {
+	flag.BoolVar(dryrun, "n", false, "same as -dryrun")
+	flag.Var(&flags, "endpoint", "push to `url=...,key=...` instead of $NR_URL, the key defaults to $NR_KEY, name=... for -route, flush=... and timeout=... instead of -f and -t (repeatable)")
+	flag.Var(&rules, "route", "send lines matching `to=name,level=a|b` or to=name,match=regexp only to that endpoint (repeatable)")
+	flag.Var(&redact, "redact", "replace what this `regexp` matches in each line with "+redacted+" (repeatable)")
+	flag.Var(attrs, "attr", "add `key=value` as an attribute of every log line (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), man)
+		flag.PrintDefaults()
+	}
+	rand.Seed(time.Now().UnixNano())
+}
+
+// newrelic says their max plaintext limit is 1MiB, i dont trust them.
+// it's the default -maxbatch
+const hiwater = 1024 * 1023
+
+// maxplain is that limit, it applies to the payload before compression
+const maxplain = 1024 * 1024
+
+// batchmax is where the collector starts a new box, -maxbatch. sizes are
+// estimated assuming every byte of a message is escaped, which it almost
+// never is, so with -gzip we aim for twice that and let fit check the
+// real size
+func batchmax() int {
+	if *gz {
+		return 2 * *maxbatch
+	}
+	return *maxbatch
+}
+
+// payloadmax is the largest payload fit lets through, newrelic's limit,
+// unless -maxbatch says the endpoint takes more
+func payloadmax() int {
+	if *maxbatch > maxplain {
+		return *maxbatch
+	}
+	return maxplain
+}
+
+func main() {
+	flag.Parse()
+	if *showversion {
+		fmt.Println(about())
+		return
+	}
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			fatal("config: %v", err)
+		}
+	}
+	if *checkhealth {
+		if *metricsaddr == "" {
+			fatal("-health needs the -metrics addr of the logpipe to ask")
+		}
+		os.Exit(health(*metricsaddr))
+	}
+	if *keysource != "" {
+		k, u, err := secret(*keysource)
+		if err != nil {
+			fatal("provide license via -keysource: %v", err)
+		}
+		key = k
+		if uri == "" {
+			uri = u
+		}
+	}
+	if key == "" && *keyfile != "" {
+		b, err := os.ReadFile(*keyfile)
+		if err != nil {
+			fatal("provide license via -keyfile: %v", err)
+		}
+		if key = strings.TrimSpace(string(b)); key == "" {
+			fatal("provide license via -keyfile: %s is empty", *keyfile)
+		}
+	}
+	if !*nohost {
+		hostattrs()
+	}
+	envattrs(*envattr)
+	if *logtype != "" {
+		attrs["logtype"] = *logtype
+	}
+	if *region == "" {
+		*region = strings.TrimSpace(os.Getenv("NR_REGION"))
+	}
+	def, ok := regions[strings.ToUpper(*region)]
+	if *region == "" {
+		def, ok = defaulturl, true
+	}
+	if !ok {
+		fatal("bad -region: %q, want US or EU", *region)
+	}
+	eps, err := resolve(flags, uri, key, def)
+	if err != nil {
+		fatal("%v", err)
+	}
+	for _, ep := range eps {
+		if ep.key != "" || *dryrun {
+			continue
+		}
+		if len(eps) == 1 {
+			fatal("provide license via $NR_KEY\nexport NR_KEY=")
+		}
+		fatal("provide license for %s via $NR_KEY or -endpoint", ep)
+	}
+	if *levelregex != "" {
+		if levelre, err = regexp.Compile(*levelregex); err != nil {
+			fatal("bad -levelregex: %v", err)
+		}
+		*levels = true
+	}
+	if *multiline != "" {
+		re, err := regexp.Compile(*multiline)
+		if err != nil {
+			fatal("bad -multiline: %v", err)
+		}
+		multi = &merger{re: re, max: *maxline}
+	}
+	if *delimiter != "" {
+		if delim, err = parsedelim(*delimiter); err != nil {
+			fatal("bad -delim: %v", err)
+		}
+	}
+	if *traceregex != "" {
+		if tracere, err = regexp.Compile(*traceregex); err != nil {
+			fatal("bad -traceregex: %v", err)
+		}
+		if tracere.SubexpIndex("trace_id") < 0 && tracere.SubexpIndex("span_id") < 0 {
+			fatal("bad -traceregex: want a (?P<trace_id>...) or (?P<span_id>...) group")
+		}
+	}
+	if *flushon != "" {
+		if urgent, err = regexp.Compile(*flushon); err != nil {
+			fatal("bad -flushon: %v", err)
+		}
+	}
+	if *maxbatch < 1024 || *maxbatch > 64<<20 {
+		fatal("bad -maxbatch: %d, want 1024 to %d bytes", *maxbatch, 64<<20)
+	}
+	if *maxflush > 0 && (*minflush <= 0 || *minflush > *maxflush) {
+		fatal("-minflush must be between 0 and -maxflush")
+	}
+	if *idle < 0 || *idle > 0 && *idle < 2*time.Millisecond {
+		fatal("bad -idle: %s, want at least 2ms, or 0 for off", *idle)
+	}
+	if keylim, err = newLimiter(*ratekey, *ratelimit); err != nil {
+		fatal("bad -ratelimit: %v", err)
+	}
+	if *sample <= 0 || *sample > 1 {
+		fatal("bad -sample: %v, want a fraction above 0 up to 1", *sample)
+	}
+	if *jitter < 0 || *jitter > 1 {
+		fatal("bad -jitter: %v, want a fraction from 0 to 1", *jitter)
+	}
+	if *align && *jitter > 0 {
+		fatal("-align and -jitter dont go together")
+	}
+	if *quiet {
+		*echo = "off"
+	}
+	if *echo != "raw" && *echo != "transformed" && *echo != "off" {
+		fatal("bad -echo: %q, want raw, transformed or off", *echo)
+	}
+	if *emit != "line" && *emit != "payload" {
+		fatal("bad -emit: %q, want line or payload", *emit)
+	}
+	switch *wrap {
+	case "array", "object", "ndjson":
+	default:
+		fatal("bad -wrap: %q, want array, object or ndjson", *wrap)
+	}
+	switch *overflow {
+	case "":
+		*overflow = "block"
+		if *drop {
+			*overflow = "ring"
+		}
+		if *spoolpath != "" {
+			*overflow = "spool"
+		}
+	case "block", "ring":
+	case "spool":
+		if *spoolpath == "" {
+			fatal("-overflow spool needs -spool")
+		}
+	default:
+		fatal("bad -overflow: %q, want block, ring or spool", *overflow)
+	}
+	if *qlen < 1 {
+		fatal("bad -qlen: %d", *qlen)
+	}
+	if *maxline < 1 {
+		fatal("bad -maxline: %d", *maxline)
+	}
+	if *workers < 1 {
+		fatal("bad -workers: %d", *workers)
+	}
+	if *tmpltext != "" {
+		if tmpl, err = parseTemplate(*tmpltext); err != nil {
+			fatal("bad -template: %v", err)
+		}
+	}
+	switch *tsunit {
+	case "auto", "s", "ms", "us", "ns":
+	default:
+		fatal("bad -tsunit: %q", *tsunit)
+	}
+	if *tsclamp < 0 {
+		fatal("bad -tsclamp: %s", *tsclamp)
+	}
+
+	if client, err = newClient(); err != nil {
+		fatal("%v", err)
+	}
+	for i := range eps {
+		if path := sockpath(eps[i].url); path != "" {
+			eps[i].sock = unixClient(client, path)
+		}
+	}
+	if *debug {
+		banner(eps)
+	}
+	if *validate {
+		os.Exit(check(eps))
+	}
+	if *oneshot {
+		if flag.NArg() == 0 {
+			fatal("-once needs a message")
+		}
+		os.Exit(once(eps, strings.Join(flag.Args(), " ")))
+	}
+	in, err := input()
+	if err != nil {
+		fatal("%v", err)
+	}
+	if *filtercmd != "" {
+		if filt, err = startFilter(*filtercmd); err != nil {
+			fatal("filter: %v", err)
+		}
+	}
+
+	if *fallbackto != "" {
+		if lastresort, err = openFallback(*fallbackto); err != nil {
+			fatal("fallback: %v", err)
+		}
+	}
+
+	sinks := []*sink{}
+	for _, ep := range eps {
+		if *rps > 0 {
+			ep.lim = rate.NewLimiter(rate.Limit(*rps), 1)
+		}
+		ring := *overflow == "ring" || *overflow == "spool" && *drop
+		s := &sink{endpoint: ep, q: newQueue(*maxbuffer, ring), br: newBreaker(ep.url, *trip, *cooldown)}
+		if *spoolpath != "" {
+			if s.sp, err = openSpool(spoolfor(*spoolpath, ep, len(eps))); err != nil {
+				fatal("spool: %v", err)
+			}
+		}
+		if *walpath != "" {
+			if s.wal, s.unacked, err = openWAL(spoolfor(*walpath, ep, len(eps))); err != nil {
+				fatal("wal: %v", err)
+			}
+			s.q.forget = s.wal.ack
+		}
+		if *overflow == "spool" {
+			s.q.spill = s.spill
+		}
+		sinks = append(sinks, s)
+	}
+
+	dest, err := dests(sinks)
+	if err != nil {
+		fatal("%v", err)
+	}
+	if len(dest[0]) == 0 {
+		warn("every endpoint has a -route, lines that match none of them are dropped")
+	}
+	for _, rt := range rules {
+		if rt.levels != nil {
+			*levels = true
+		}
+	}
+
+	if *stall > 0 {
+		go watch(sinks)
+	}
+	dumpc := make(chan os.Signal, 1)
+	notifyDump(dumpc)
+	go func() {
+		for range dumpc {
+			dump(sinks)
+		}
+	}()
+
+	var ms *metrics
+	if *metricsaddr != "" {
+		if ms, err = serveMetrics(*metricsaddr, sinks); err != nil {
+			fatal("metrics: %v", err)
+		}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan bool)
+	cols := collectors(sinks, dest)
+	if !*flushstdout {
+		go func() {
+			for range time.Tick(every(*deadband)) {
+				stdout.flush()
+			}
+		}()
+	}
+
+	// the pushers, one per endpoint, each owns every box handed to it
+	shipped := sync.WaitGroup{}
+	for _, s := range sinks {
+		shipped.Add(1)
+		go func(s *sink) {
+			defer shipped.Done()
+			ship(s)
+		}(s)
+	}
+
+	go func() {
+		defer close(done)
+		collected := sync.WaitGroup{}
+		for _, c := range cols {
+			d := every(c.f)
+			phase := jittered(d, *jitter)
+			if *align {
+				phase = aligned(time.Now(), d)
+			}
+			collected.Add(1)
+			go func(c *collector, tick <-chan time.Time) {
+				defer collected.Done()
+				batch(c.linec, tick, c.f, func(r int, box Box) {
+					if *echo != "off" && *emit == "payload" && c.emit[r] {
+						// split like ship does, so these are the payloads sent
+						for _, box := range splitBox(box, batchmax()) {
+							for _, box := range fit(box) {
+								stdout.println(payload(box))
+							}
+						}
+					}
+					for _, s := range c.dest[r] {
+						s.q.put(s.wal.write(box))
+					}
+					stdout.flush()
+				})
+			}(c, ticks(d, phase))
+		}
+		collected.Wait()
+
+		// wait for the pushers to finish what we gave them
+		for _, s := range sinks {
+			s.q.close()
+		}
+		shipped.Wait()
+	}()
+
+	// scan lines from the input
+	//
+	// the lines are read by scan on its own goroutine, so a signal can
+	// interrupt us while we are blocked reading. on one, ctx is canceled
+	// and we stop at once, closing each linec behind whatever is already
+	// in it. the read itself is never stopped, the process simply exits
+	// from under it.
+	//
+	// rerr is why it stopped, if not the end of the input. it is safe to
+	// read after done is closed
+	ctx, interrupt := context.WithCancel(context.Background())
+	var rerr error
+	go func() {
+		defer func() {
+			dbg("scanner: done")
+			exiting(sinks)
+			for _, c := range cols {
+				close(c.linec)
+			}
+			dbg("linec closed")
+		}()
+
+		// send hands l to each collector. it blocks, or drops with -drop,
+		// while their linec is full
+		warned := time.Time{}
+		sendto := func(linec chan Log, l Log) {
+			select {
+			case linec <- l:
+				return
+			default:
+			}
+			what := "blocking"
+			if *drop {
+				count(&stats.dropped, 1)
+				what = "dropping"
+			} else {
+				count(&stats.blocked, 1)
+			}
+			if time.Since(warned) > 10*time.Second {
+				warned = time.Now()
+				warn("backpressure: %d lines read ahead (-qlen), %s", *qlen, what)
+			}
+			if !*drop {
+				select {
+				case linec <- l:
+				case <-ctx.Done():
+				}
+			}
+		}
+		send := func(l Log) {
+			count(&stats.lines, 1)
+			fanout(cols, l, sendto)
+		}
+		put := func(line []byte) {
+			if l, ok := parse(line); ok && keylim.allow(l) {
+				send(clip(l))
+			}
+		}
+
+		// with -multiline, lines are joined after -redact and -filter, one
+		// line at a time, and an entry is held until a line that doesnt
+		// continue it, or until nothing has continued it for mergewait
+		idle := time.NewTimer(mergewait)
+		idle.Stop()
+		flush := func() {
+			if e := multi.flush(); e != nil && sampled(e) {
+				put(e)
+			}
+		}
+		handle := func(raw []byte) error {
+			if *echo == "raw" && *emit == "line" {
+				stdout.println(raw)
+			}
+			// every line is echoed, so with -echo transformed, every line
+			// is transformed before -sample
+			shown := *echo == "transformed" && *emit == "line"
+			if *skipblank && len(bytes.TrimSpace(raw)) == 0 {
+				if shown {
+					stdout.println(raw) // blank either way
+				}
+				count(&stats.blank, 1)
+				return nil
+			}
+			if multi == nil && !shown && !sampled(raw) {
+				return nil
+			}
+			line, err := transform(raw)
+			if err != nil || line == nil {
+				return err
+			}
+			if shown {
+				stdout.println(line)
+				if multi == nil && !sampled(raw) {
+					return nil
+				}
+			}
+			if multi == nil {
+				put(line)
+				return nil
+			}
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(mergewait)
+			if e := multi.add(line); e != nil && sampled(e) {
+				put(e)
+			}
+			return nil
+		}
+		lines, errc := scan(ctx, in)
+		for {
+			select {
+			case <-ctx.Done():
+				dbg("scanner: interrupted")
+				return
+			case <-idle.C:
+				flush()
+			case raw, more := <-lines:
+				if more {
+					if rerr = handle(raw); rerr != nil {
+						warn("%v", rerr)
+						return
+					}
+					continue
+				}
+				if multi != nil {
+					flush()
+				}
+				if rerr = <-errc; rerr == bufio.ErrTooLong {
+					warn("read: stopped at a line longer than -maxline %d bytes", *maxline)
+				} else if rerr != nil {
+					warn("read: %v", rerr)
+				}
+				return
+			}
+		}
+	}()
+
+	// These channels are not redundant:
+	//
+	// first, the scanner finishes (or we get a signal, and interrupt it)
+	// second, we wait for the USPS goroutine above to finish shipping the existing logs
+	// finally, and only then, we can exit the process without losing tail logs
+	//
+	// The final flush, retries and all, is bounded by -shutdown, see
+	// exiting. If that's not soon enough, a second signal exits without
+	// waiting for it. -maxlife running out is the first signal.
+	force := func() {
+		go func() {
+			sig := <-sigc
+			fatal("%s: exiting without flush", sig)
+		}()
+	}
+	var expired <-chan time.Time
+	if *maxlife > 0 {
+		expired = time.After(*maxlife)
+	}
+	select {
+	case <-done:
+	case <-expired:
+		info(map[string]any{"maxlife": maxlife.String()}, "maxlife: up after %s, flushing and exiting", *maxlife)
+		force()
+		interrupt()
+		<-done
+	case sig := <-sigc:
+		dbg("signal: %s", sig)
+		force()
+		interrupt()
+		<-done
+		stdout.flush()
+		summary()
+		ms.close()
+		dbg("exits")
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}
+	stdout.flush()
+	summary()
+	ms.close()
+	dbg("exits")
+	if rerr != nil {
+		os.Exit(1)
+	}
+}
+
+// check pushes a log saying so to each endpoint, for -validate, and prints
+// whether it worked. it returns the exit code
+func check(eps []endpoint) (code int) {
+	box := Box{Common: common(), Log: []Log{newLog("logpipe: validate", time.Now().UnixMilli())}}
+	for _, ep := range eps {
+		if err := push(client, ep, box); err != nil {
+			warn("%s: %v", ep, err)
+			code = 1
+			continue
+		}
+		fmt.Println("OK", ep)
+	}
+	return code
+}
+
+// banner prints the configuration logpipe ended up with, for -debug, to
+// catch a wrong $NR_URL or an empty $NR_KEY before any push fails
+func banner(eps []endpoint) {
+	for _, ep := range eps {
+		f, t := *deadband, *timeout
+		if ep.flush > 0 {
+			f = ep.flush
+		}
+		if ep.timeout > 0 {
+			t = ep.timeout
+		}
+		diag("debug", map[string]any{"endpoint": ep.url, "name": ep.name, "key": masked(ep.key), "flush": f.String(), "timeout": t.String()},
+			"config: endpoint %s name=%q key=%s flush=%s timeout=%s", ep, ep.name, masked(ep.key), f, t)
+	}
+	diag("debug", map[string]any{"flush": deadband.String(), "timeout": timeout.String(), "retries": *retries, "workers": *workers},
+		"config: flush every %s, timeout %s, %d retries, %d workers", *deadband, *timeout, *retries, *workers)
+	set := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		set = append(set, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	diag("debug", map[string]any{"flags": set}, "config: flags: %s", strings.Join(set, " "))
+}
+
+// masked is what the banner shows of a key: how long it is, and its last
+// four characters if it's long enough that they give nothing away
+func masked(key string) string {
+	switch {
+	case key == "":
+		return "none"
+	case len(key) < 16:
+		return fmt.Sprintf("%d chars", len(key))
+	}
+	return fmt.Sprintf("%d chars ...%s", len(key), key[len(key)-4:])
+}
+
+// once pushes msg to each endpoint as a single log, parsed like any line
+// read would be, and returns the exit code
+func once(eps []endpoint, msg string) (code int) {
+	line, _ := transform([]byte(msg))
+	l, ok := parse(line)
+	if !ok {
+		return 0
+	}
+	box := Box{Common: common(), Log: []Log{clip(l)}}
+	for _, ep := range eps {
+		if err := retry(client, ep, box); err != nil {
+			checkkey(err)
+			warn("%s: %v", ep, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// scan reads lines from in and sends them on the returned channel, which
+// is closed at the end of the input, or once ctx is done. then, the
+// error channel says why, nil if it was the end of the input
+func scan(ctx context.Context, in io.Reader) (<-chan []byte, <-chan error) {
+	lines, errc := make(chan []byte), make(chan error, 1)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(in)
+		n := 4096
+		if *maxline < n {
+			n = *maxline // or the buffer's size is the limit instead
+		}
+		sc.Buffer(make([]byte, 0, n), *maxline)
+		sc.Split(scanlines)
+		for sc.Scan() {
+			select {
+			case lines <- append([]byte{}, sc.Bytes()...):
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+		errc <- sc.Err()
+	}()
+	return lines, errc
+}
+
+// delim is what lines end in, see -delim
+var delim byte = '\n'
+
+// parsedelim returns the byte s is, or its escape
+func parsedelim(s string) (byte, error) {
+	if s == `\0` {
+		return 0, nil
+	}
+	c, _, tail, err := strconv.UnquoteChar(s, 0)
+	if err != nil || tail != "" || c > 0xff || (s[0] != '\\' && c >= utf8.RuneSelf) {
+		return 0, fmt.Errorf("%q: want one byte, or an escape like \\0, \\t or \\x1e", s)
+	}
+	return byte(c), nil
+}
+
+// scanlines is bufio.ScanLines, but with -nopartial it drops anything left
+// at the end of the input without a newline. with -delim, lines end in
+// that instead, and there is no \r to drop
+func scanlines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && *nopartial && len(data) > 0 && bytes.IndexByte(data, delim) < 0 {
+		dbg("read: dropping partial line: %q", data)
+		return len(data), nil, nil
+	}
+	if delim == '\n' {
+		return bufio.ScanLines(data, atEOF)
+	}
+	if i := bytes.IndexByte(data, delim); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// hostattrs adds the hostname and logpipe's pid to the attributes, unless
+// they're set already
+func hostattrs() {
+	if _, ok := attrs["hostname"]; !ok {
+		if h, err := os.Hostname(); err == nil {
+			attrs["hostname"] = h
+		}
+	}
+	if _, ok := attrs["pid"]; !ok {
+		attrs["pid"] = os.Getpid()
+	}
+}
+
+// envattrs adds the environment variables named in the comma separated
+// list as attributes named after them, unless they're unset, empty, or
+// set already by -attr
+func envattrs(list string) {
+	for _, k := range split(list) {
+		if v := os.Getenv(k); k != "" && v != "" {
+			if _, ok := attrs[k]; !ok {
+				attrs[k] = v
+			}
+		}
+	}
+}
+
+// input opens the file named by -in or the argument, or returns stdin,
+// decompressed with -gzipin. more than one argument are read one after
+// the other
+func input() (io.Reader, error) {
+	paths := flag.Args()
+	if *inpath != "" {
+		if len(paths) > 0 {
+			return nil, fmt.Errorf("both -in and a file argument given")
+		}
+		paths = []string{*inpath}
+	}
+	if len(paths) > 1 {
+		if *tail {
+			return nil, fmt.Errorf("cant -F more than one file")
+		}
+		// dont find a typo an hour into a backfill
+		for _, p := range paths {
+			if _, err := os.Stat(p); err != nil && p != "-" {
+				return nil, err
+			}
+		}
+		return &files{paths: paths}, nil
+	}
+	path := ""
+	if len(paths) == 1 {
+		path = paths[0]
+	}
+	in, err := open(path)
+	if err != nil || !*gzipin {
+		return in, err
+	}
+	if *tail {
+		return nil, fmt.Errorf("cant -F a -gzipin file")
+	}
+	return gunzip(in)
+}
+
+// gunzip decompresses in for -gzipin
+func gunzip(in io.Reader) (io.Reader, error) {
+	// concatenated gzip streams, like from cat a.gz b.gz, are read one
+	// after the other
+	zr, err := gzip.NewReader(bufio.NewReader(in))
+	switch err {
+	case nil:
+		return zr, nil
+	case io.EOF:
+		return strings.NewReader(""), nil
+	case gzip.ErrHeader, io.ErrUnexpectedEOF:
+		return nil, fmt.Errorf("-gzipin: the input isnt gzipped")
+	}
+	return nil, fmt.Errorf("-gzipin: %v", err)
+}
 
-SYNOPSIS
-	export NR_KEY=""
-	export NR_URL="" # optional
-	echo hi newrelic | logpipe 
-	app 2>&1 | logpipe [-f flushdur] [-t httptimeout] [-debug]
+func open(path string) (io.Reader, error) {
+	if path == "" || path == "-" {
+		if *tail {
+			return nil, fmt.Errorf("-F needs a file to follow")
+		}
+		return os.Stdin, nil
+	}
+	if *tail {
+		return follow(path)
+	}
+	// a named pipe blocks here until someone opens it for writing
+	return os.Open(path)
+}
 
-DESCRIPTION
-	Logpipe sends every line read from its standard input to
-	newrelic as a log line. If the log line is valid json, and contains
-	an integer "ts" fields at its top level, that value is used as the
-	newrelic timestamp. By default, each line read is re-emitted
-	to standard output (see -q).
+// files reads the named files in order, as if they were one, each one
+// opened when the one before it ends, and decompressed with -gzipin. a
+// file that doesnt end in a newline, or -delim, gets one, so its last
+// line isnt joined to the next file's first
+type files struct {
+	paths []string
+	cur   io.Reader // nil between files
+	f     io.Closer
+	last  byte
+}
 
-	Logpipe will automatically batch log lines. See FLAGS
+func (r *files) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			path := r.paths[0]
+			r.paths = r.paths[1:]
+			in, err := open(path)
+			if err != nil {
+				return 0, err
+			}
+			r.cur, r.f, r.last = in, in.(io.Closer), delim
+			if *gzipin {
+				if r.cur, err = gunzip(in); err != nil {
+					r.f.Close()
+					return 0, fmt.Errorf("%s: %v", path, err)
+				}
+			}
+			dbg("read: %s", path)
+		}
+		n, err := r.cur.Read(p)
+		if n > 0 {
+			r.last = p[n-1]
+		}
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil // and EOF again next time
+		}
+		r.f.Close()
+		r.cur = nil
+		if r.last != delim && len(r.paths) > 0 && len(p) > 0 {
+			p[0], r.last = delim, delim
+			return 1, nil
+		}
+	}
+}
 
-	Set at least NR_KEY to your newrelic license key and run
-	the examples as above. If you are in a different region, set
-	$NR_URL too.
+// quit is canceled once we have been exiting for longer than -shutdown.
+// pushes in flight are abandoned, and the rest dont start
+var quit, abandon = context.WithCancel(context.Background())
 
-BUGS
-	(1) Process signals are currently not intercepted
-	(2) If push fails, the buffered log lines are lost
+// exiting starts the -shutdown clock, it's called once there's nothing
+// left to read, or we were interrupted, and not after the collectors are
+// done, they may be stuck behind a full -maxbuffer until quit. that
+// wakes the sinks' queues
+func exiting(sinks []*sink) {
+	exitonce.Do(func() {
+		if *shutdown > 0 {
+			time.AfterFunc(*shutdown, func() {
+				dbg("shutdown: out of time")
+				abandon()
+				for _, s := range sinks {
+					s.q.wake()
+				}
+			})
+		}
+	})
+}
 
-FLAGS`
+var exitonce sync.Once
 
-var (
-	deadband = flag.Duration("f", 5*time.Second, "flush logs after this duration")
-	timeout  = flag.Duration("t", 5*time.Second, "http timeout")
-	debug    = flag.Bool("debug", false, "debug output to stderr")
-	quiet    = flag.Bool("q", false, "dont emit each log line read back to stdout (default behavior)")
+// ship pushes boxes from the sink's queue until it is closed and drained,
+// with -workers pushers at once. with a spool, boxes that fail go to it,
+// and whatever is in it goes out before the next box does
+func ship(s *sink) {
+	s.catchup()
+	late := int64(0)
+	defer func() {
+		if late > 0 {
+			warn("%s: shutdown: dropped %d lines after %s", s, late, *shutdown)
+		}
+	}()
+	wg := sync.WaitGroup{}
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				b, ok := s.q.get()
+				if !ok {
+					return
+				}
+				count(&late, s.send(b).late)
+				s.q.done(b)
+			}
+		}()
+	}
+	wg.Wait()
+}
 
-	key = os.Getenv("NR_KEY")
-	uri = os.Getenv("NR_URL")
-)
+// send delivers b, split to fit, counts what became of its lines, and
+// acks it in the -wal if none of them are left to push again
+func (s *sink) send(b Box) tally {
+	t, pushes := tally{}, 0
+	for _, box := range splitBox(b, batchmax()) {
+		for _, box := range fit(box) {
+			t = t.plus(deliver(s, box))
+			pushes++
+		}
+	}
+	count(&stats.sent, t.sent)
+	count(&stats.kept, t.spooled+t.kept)
+	count(&stats.lost, t.refused+t.dropped+t.late)
+	dbg("%s: flush: %d lines in %d pushes: %d pushed, %d spooled or kept, %d dropped",
+		s, len(b.Log), pushes, t.sent, t.spooled+t.kept, t.refused+t.dropped+t.late)
+	if t.unsent() == 0 {
+		s.wal.ack(b)
+	}
+	return t
+}
 
-func init() {
-	flag.Usage = func() {
-		fmt.Fprintln(flag.CommandLine.Output(), man)
-		flag.PrintDefaults()
+// catchup pushes what a previous run left, the spool and then the boxes
+// the -wal never acked, before anything new. while the endpoint is down,
+// each push is retried like a live one, and then the whole replay again,
+// with the same backoff, until it's all gone or we are out of time. the
+// lines read meanwhile wait in the queue, or with -spool, after the rest
+// in it
+func (s *sink) catchup() {
+	left := s.unacked
+	s.unacked = nil
+	if len(left) == 0 && (s.sp == nil || s.sp.len() == 0) {
+		return
+	}
+	s.replaying = true
+	for n := 0; quit.Err() == nil; n++ {
+		if s.sp == nil || s.sp.replay(client, s.endpoint, retry) {
+			for len(left) > 0 && s.send(left[0]).again == 0 {
+				left = left[1:]
+			}
+			// with -spool, the wal boxes that failed are in it now
+			if len(left) == 0 && (s.sp == nil || s.sp.len() == 0) {
+				break
+			}
+		}
+		d := backoff(n)
+		warn("%s: replay: still failing, trying again in %s", s, d)
+		select {
+		case <-time.After(d):
+		case <-quit.Done():
+		}
+	}
+	s.replaying = false
+	for _, box := range left {
+		s.send(box) // out of time, lost or spooled
 	}
 }
 
-// newrelic says their max plaintext limit is 1MiB, i dont trust them
-const hiwater = 1024 * 1023
+// tally is what became of the lines of a box, or the boxes it was split
+// into, see deliver
+type tally struct {
+	sent    int // pushed
+	refused int // for good, by the endpoint
+	spooled int
+	kept    int // in -fallback, or left in the -wal
+	dropped int // after the retries ran out
+	late    int // dropped at shutdown, out of time
+	again   int // to be tried again by catchup
+}
 
-// TODO(as): Intercept process SIGINT and SIGKILL
-func main() {
-	flag.Parse()
-	if key == "" {
-		fmt.Fprintln(os.Stderr, "logpipe: provide license via $NR_KEY\nexport NR_KEY=")
-		os.Exit(1)
+func (t tally) plus(u tally) tally {
+	return tally{
+		sent: t.sent + u.sent, refused: t.refused + u.refused, spooled: t.spooled + u.spooled,
+		kept: t.kept + u.kept, dropped: t.dropped + u.dropped, late: t.late + u.late,
+		again: t.again + u.again,
+	}
+}
+
+// unsent is how many lines werent pushed, refused or spooled, which the
+// -wal keeps for next time
+func (t tally) unsent() int {
+	return t.kept + t.dropped + t.late + t.again
+}
+
+// deliver pushes box to s, spools it, or drops it, and says which it did
+// with how many of its lines. a box too large is split, and the halves
+// may not end up the same way
+func deliver(s *sink, box Box) tally {
+	if d := s.br.wait(); d > 0 && quit.Err() == nil {
+		// the breaker is open, the box waits in the spool, or here
+		if s.sp != nil {
+			return save(s, box)
+		}
+		select {
+		case <-time.After(d):
+		case <-quit.Done():
+		}
+		return deliver(s, box)
 	}
-	if uri == "" {
-		uri = "https://log-api.newrelic.com/log/v1"
+	switch {
+	case quit.Err() != nil && s.sp == nil:
+		return lose(s, box)
+	case quit.Err() != nil:
+		return save(s, box)
+	case s.sp != nil && s.sp.held():
+		return save(s, box)
+	case s.sp != nil && !s.sp.replay(client, s.endpoint, push):
+		// still down, dont bother retrying
+		s.br.record(false)
+		return save(s, box)
 	}
+	var err error
+	probe := s.br.probing()
+	if probe {
+		err = push(client, s.endpoint, box)
+	} else {
+		err = retry(client, s.endpoint, box)
+	}
+	checkkey(err)
+	var se *statusError
+	s.br.record(err == nil || errors.As(err, &se) && se.permanent())
+	n := len(box.Log)
+	switch {
+	case err == nil:
+		return tally{sent: n}
+	case errors.As(err, &se) && se.code == http.StatusRequestEntityTooLarge && len(box.Log) > 1:
+		n /= 2
+		dbg("%s: too large, splitting %d lines at %d", s, len(box.Log), n)
+		t := deliver(s, Box{Common: box.Common, Log: box.Log[:n]})
+		return t.plus(deliver(s, Box{Common: box.Common, Log: box.Log[n:]}))
+	case errors.As(err, &se) && se.permanent():
+		// retrying, or spooling it to retry later, wont change a thing
+		diag("warn", map[string]any{"endpoint": s.url, "dropped": n, "error": err.Error(), "body": se.body},
+			"%s: push refused: dropped %d lines: %v: %s", s, n, err, se.body)
+		return tally{refused: n}
+	case quit.Err() != nil && s.sp == nil:
+		return lose(s, box)
+	case probe && s.sp == nil:
+		return deliver(s, box) // wait out the next cooldown with it
+	case s.sp != nil:
+		return save(s, box)
+	case s.replaying:
+		dbg("%s: replay: %d lines failed: %v", s, n, err)
+		return tally{again: n}
+	case lastresort.keep(box):
+		diag("warn", map[string]any{"endpoint": s.url, "fallback": n, "error": err.Error()},
+			"%s: push failed after %d retries: wrote %d lines to -fallback: %v", s, *retries, n, err)
+		return tally{kept: n}
+	case s.wal != nil:
+		diag("warn", map[string]any{"endpoint": s.url, "unacked": n, "error": err.Error()},
+			"%s: push failed after %d retries: left %d lines in the -wal for next time: %v", s, *retries, n, err)
+		return tally{kept: n}
+	}
+	diag("warn", map[string]any{"endpoint": s.url, "dropped": n, "error": err.Error()},
+		"%s: push failed after %d retries: dropped %d lines: %v", s, *retries, n, err)
+	return tally{dropped: n}
+}
 
-	linec := make(chan Log, 256)
-	done := make(chan bool)
-	ticker := time.NewTicker(*deadband)
-	go func() {
-		// collect the lines into boxes and periodically flush them to nr
-		box := Box{
-			Log: []Log{},
+// lose drops box because we are out of time to push it, unless -fallback
+// keeps it
+func lose(s *sink, box Box) tally {
+	if lastresort.keep(box) {
+		dbg("%s: shutdown: wrote %d lines to -fallback", s, len(box.Log))
+		return tally{kept: len(box.Log)}
+	}
+	return tally{late: len(box.Log)}
+}
+
+// save spools box, or drops it if it cant
+func save(s *sink, box Box) tally {
+	if err := s.sp.append(box); err != nil {
+		warn("%s: spool: dropped %d lines: %v", s, len(box.Log), err)
+		return tally{dropped: len(box.Log)}
+	}
+	dbg("%s: spool: saved %d lines", s, len(box.Log))
+	return tally{spooled: len(box.Log)}
+}
+
+// spill spools box for s's queue, once it's full, and says whether it
+// could
+func (s *sink) spill(box Box) bool {
+	if save(s, box).spooled == 0 {
+		return false
+	}
+	count(&stats.kept, len(box.Log))
+	s.wal.ack(box)
+	return true
+}
+
+// splitBox divides box into boxes that are each under max bytes, in order.
+// a line too big to fit in a box by itself is truncated so it does
+func splitBox(box Box, max int) (boxes []Box) {
+	empty := Box{Common: box.Common}.Len()
+	cur, n := Box{Common: box.Common}, empty
+	for _, l := range box.Log {
+		if empty+l.Len() > max {
+			l = truncate(l, max-box.Common.Len())
 		}
-		flush := func() {
-			push(box)
-			// NOTE(as) theres a bug here where if the upstream
-			// fails, the logs in box above will be lost
-			// i dont expect this to be relevant to my current
-			// use case for this program.
-			//
-			// If you want to fix this, check the return value of
-			// push above and then split the boxes at the hiwater mark
-			// instead of creating a fresh one below.
-			//
-			// Alternatively, you can just use push in a loop until
-			// it returns true. The scanner should continue collecting
-			// lines concurrently.
-			box = Box{}
+		if len(cur.Log) > 0 && n+l.Len() > max {
+			boxes = append(boxes, cur)
+			cur, n = Box{Common: box.Common}, empty
 		}
-		defer close(done)
-		for {
+		cur.Log = append(cur.Log, l)
+		n += l.Len()
+	}
+	if len(cur.Log) > 0 {
+		boxes = append(boxes, cur)
+	}
+	return boxes
+}
+
+// fit halves box until the marshaled payload of each half is within
+// payloadmax
+func fit(box Box) []Box {
+	if len(box.Log) < 2 || len(payload(box)) <= payloadmax() {
+		return []Box{box}
+	}
+	n := len(box.Log) / 2
+	dbg("fit: splitting %d lines at %d", len(box.Log), n)
+	return append(fit(Box{Common: box.Common, Log: box.Log[:n]}), fit(Box{Common: box.Common, Log: box.Log[n:]})...)
+}
+
+const truncated = "…[truncated]"
+
+// truncate cuts the message in l so that a box holding only l is under
+// max bytes, and marks it as such
+func truncate(l Log, max int) Log {
+	room := (max-Box{}.Len()-Log{}.Len())/2 - len(truncated)
+	if room < 0 {
+		room = 0
+	}
+	if room >= len(l.M) {
+		return l
+	}
+	for room > 0 && !utf8.RuneStart(l.M[room]) {
+		room--
+	}
+	dbg("truncate: %d bytes to %d", len(l.M), room)
+	l.M = l.M[:room] + truncated
+	return l
+}
+
+// retry pushes box with c until it succeeds or we run out of retries. it
+// returns the last push's error, or straight away, one that retrying
+// wont fix
+func retry(c *http.Client, ep endpoint, box Box) error {
+	for n := 0; ; n++ {
+		err := push(c, ep, box)
+		var se *statusError
+		if err == nil || errors.Is(err, errLicense) || errors.As(err, &se) && se.permanent() {
+			return err
+		}
+		if n >= *retries {
+			return err
+		}
+		d := backoff(n)
+		if se != nil && se.after > d {
+			dbg("push: %s: retry-after %s", ep, se.after)
+			d = se.after
+		}
+		info(map[string]any{"endpoint": ep.url, "retry": n + 1, "wait": d.String(), "error": err.Error()},
+			"push: %s: retry %d/%d in %s: %v", ep, n+1, *retries, d, err)
+		select {
+		case <-time.After(d):
+		case <-quit.Done():
+			return err
+		}
+	}
+}
+
+// errLicense is returned by push when newrelic refuses the license key
+var errLicense = errors.New("bad license key")
+
+// checkkey exits if err is errLicense, no amount of retrying will fix it
+func checkkey(err error) {
+	if errors.Is(err, errLicense) {
+		fatal("%v", err)
+	}
+}
+
+// statusError is a push newrelic answered with a failing status
+type statusError struct {
+	code   int
+	status string
+	after  time.Duration // how long Retry-After says to wait, if at all
+	body   string        // the start of it, newrelic says what's wrong here
+}
+
+func (e *statusError) Error() string { return e.status }
+
+// permanent says whether pushing the same box again would fail the same
+// way. newrelic's 5xx are transient, as are timeouts and throttling, but
+// a 400 means the box is bad and a 413 that it's too big
+func (e *statusError) permanent() bool {
+	return e.code/100 == 4 && e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
+
+// newID returns a random uuid, version 4, for -requestid. math/rand is
+// plenty to tell pushes apart, and cheaper than crypto/rand
+func newID() string {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, rand.Uint64())
+	binary.BigEndian.PutUint64(b[8:], rand.Uint64())
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ticks ticks every d, like a time.Ticker, but starts after phase
+func ticks(d, phase time.Duration) <-chan time.Time {
+	ticker := time.NewTicker(d)
+	if phase <= 0 {
+		return ticker.C
+	}
+	ticker.Stop()
+	c := make(chan time.Time, 1)
+	go func() {
+		dbg("flush: starting in %s", phase)
+		time.Sleep(phase)
+		ticker.Reset(d)
+		for t := range ticker.C {
 			select {
-			case t := <-ticker.C: // prevent stale logs
-				dbg("tick: %s", t)
-				flush()
-			case l, more := <-linec: // collect
-				if !more {
-					dbg("linec: closed")
-					flush()
-					return
-				}
-				if n, m := l.Len(), box.Len(); n+m > hiwater {
-					dbg("forcing flush: old=%d new=%d", n, m)
-					flush()
-				}
-				box.Log = append(box.Log, l)
+			case c <- t:
+			default: // the collector is busy, like a ticker we drop it
 			}
 		}
 	}()
+	return c
+}
 
-	// scan lines from stdin
-	sc := bufio.NewScanner(os.Stdin)
-	for sc.Scan() {
-		ts := int64(0)
-		json.Unmarshal(sc.Bytes(), &struct{ TS *int64 }{&ts})
-		if ts == 0 {
-			ts = time.Now().Unix()
-		}
-		if !*quiet {
-			fmt.Println(sc.Text())
+// jittered is a random phase in the first fraction f of d, see -jitter
+func jittered(d time.Duration, f float64) time.Duration {
+	return time.Duration(rand.Float64() * f * float64(d))
+}
+
+// aligned is the phase to the next multiple of d on the clock, see -align
+func aligned(now time.Time, d time.Duration) time.Duration {
+	return now.Truncate(d).Add(d).Sub(now)
+}
+
+// backoff returns how long to wait before retry n. it doubles from
+// half a second, is capped at -maxbackoff, and has up to half of it
+// jittered away so a fleet of logpipes doesnt retry in lockstep
+func backoff(n int) time.Duration {
+	d := *maxback
+	if n < 16 {
+		if e := 500 * time.Millisecond << n; e < d {
+			d = e
 		}
-		linec <- Log{T: ts, M: sc.Text()}
 	}
-
-	// These channels are not redundant:
-	//
-	// first, the scanner finishes
-	// second, we wait for the USPS goroutine above to finish shipping the existing logs
-	// finally, and only then, we can exit the process without losing tail logs
-	//
-	// If you modify this program to use push in a loop, you will need an additional channel
-	// so this process can complete with a proper timeout
-	dbg("scanner: done")
-	close(linec)
-	dbg("linec closed")
-	<-done
-	dbg("exits")
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
 }
 
-// pushbox is the http meat of this operation
-func push(box Box) bool {
+// pushbox is the http meat of this operation. a failing status is a
+// *statusError, which says when to try again if newrelic did. any other
+// error is from the transport: dns, timeouts, refused connections and so on
+func push(c *http.Client, ep endpoint, box Box) (err error) {
+	id := "" // for -requestid
+	defer func() {
+		if err != nil && id != "" {
+			err = fmt.Errorf("%w (%s %s)", err, *requestid, id)
+		}
+		if err != nil {
+			result.Store(err.Error())
+		}
+	}()
 	if len(box.Log) == 0 {
 		dbg("push: nothing to flush")
-		return true
+		return nil
+	}
+	ep.throttle()
+	body := payload(box)
+	if *dryrun {
+		fmt.Fprintf(os.Stderr, "%s\n", body)
+		pushed(len(body))
+		return nil
 	}
-	dbg("log: %s", "["+js(box)+"]")
-	req, err := http.NewRequest("POST", uri, strings.NewReader("["+js(box)+"]"))
+	dbg("log: %s", body)
+	var rd io.Reader = bytes.NewReader(body)
+	size := len(body)
+	if *gz {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(body)
+		zw.Close()
+		dbg("gzip: %d -> %d bytes", len(body), buf.Len())
+		rd, size = buf, buf.Len()
+	}
+	target := ep.url
+	if ep.sock != nil {
+		c, target = ep.sock, sockurl
+	}
+	req, err := http.NewRequest("POST", target, rd)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "logpipe: bad newrelic endpoint")
-		os.Exit(1)
+		return fmt.Errorf("bad newrelic endpoint: %v", err)
+	}
+	req.Header.Add(*authhdr, auth(ep.key))
+	req.Header.Add("Content-Type", contenttype())
+	req.Header.Set("User-Agent", *useragent)
+	if *requestid != "" {
+		id = newID()
+		req.Header.Set(*requestid, id)
 	}
-	req.Header.Add("Api-Key", key)
-	req.Header.Add("Content-Type", "application/json")
-	ctx, fn := context.WithTimeout(context.Background(), *timeout)
+	if *gz {
+		req.Header.Add("Content-Encoding", "gzip")
+	}
+	tmo := *timeout
+	if ep.timeout > 0 {
+		tmo = ep.timeout
+	}
+	ctx, fn := context.WithTimeout(quit, tmo)
 	defer fn()
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	ctx = traced(ctx, ep)
+	resp, err := c.Do(req.WithContext(ctx))
 	if err != nil {
-		return false
+		dbg("push: %s: %v", ep, err)
+		count(&stats.failed, 1)
+		return err
+	}
+	dbg("push: %s: %s %s", ep, resp.Proto, resp.Status)
+
+	var msg []byte
+	if resp.StatusCode/100 > 3 {
+		// newrelic says why in the body, only the start of it is kept
+		msg, _ = io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		dbg("push: %s: response: %s", ep, bytes.TrimSpace(msg))
 	}
 
 	// subtle: if you dont read the response body in full and also close it
@@ -176,37 +1825,305 @@ func push(box Box) bool {
 	resp.Body.Close()
 
 	if resp.StatusCode == 401 || resp.StatusCode == 403 {
-		fmt.Fprintf(os.Stderr, "logpipe: bad license key: %s", resp.Status)
-		os.Exit(1)
+		return fmt.Errorf("%w for %s: %s", errLicense, ep, resp.Status)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		ep.slower()
 	}
 	if resp.StatusCode/100 > 3 {
-		return false
+		count(&stats.failed, 1)
+		return &statusError{
+			code:   resp.StatusCode,
+			status: resp.Status,
+			after:  retryafter(resp.Header.Get("Retry-After")),
+			body:   strings.TrimSpace(string(msg)),
+		}
 	}
-	return true
+	ep.faster()
+	pushed(size)
+	return nil
+}
+
+// retryafter parses a Retry-After header, which is either a number of
+// seconds or an http date
+func retryafter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(h); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
 }
 
 // Box is what is wrapped in brackets and sent to nr
 type Box struct {
-	Log []Log `json:"logs"`
+	Common *Common `json:"common,omitempty"`
+	Log    []Log   `json:"logs"`
+	wal    uint64  // its -wal id, 0 if it has none
+}
+
+// Common holds the attributes shared by every log in a box
+type Common struct {
+	A map[string]any `json:"attributes"`
+}
+
+// common returns the -attr attributes as a common block, or nil if there
+// arent any or with -nocommon, where newLog copies them into each log
+func common() *Common {
+	if *nocommon || len(attrs) == 0 {
+		return nil
+	}
+	c := &Common{A: map[string]any{}}
+	for k, v := range attrs {
+		c.A[k] = v
+	}
+	return c
 }
 
 type Log struct {
-	M string `json:"message"`
-	T int64  `json:"timestamp"`
+	M string          `json:"message"`
+	T int64           `json:"timestamp"` // epoch milliseconds, like nr wants
+	A map[string]any  `json:"-"`         // attributes, inlined next to the two above
+	R json.RawMessage `json:"-"`         // the whole log with -passthrough, M is unused
+}
+
+// newLog returns a log line with the -attr attributes and -prefix
+func newLog(msg string, ts int64) Log {
+	if *prefix != "" && msg != "" {
+		msg = *prefix + " " + msg
+	}
+	l := Log{M: msg, T: ts}
+	if *nocommon {
+		for k, v := range attrs {
+			l.Set(k, v)
+		}
+	}
+	return l
+}
+
+// clone returns l with attributes of its own, to set without touching l's
+func (l Log) clone() Log {
+	if l.A != nil {
+		a := make(map[string]any, len(l.A))
+		for k, v := range l.A {
+			a[k] = v
+		}
+		l.A = a
+	}
+	return l
+}
+
+// Set sets the attribute k, message and timestamp cant be overridden
+func (l *Log) Set(k string, v any) {
+	if l.A == nil {
+		l.A = map[string]any{}
+	}
+	l.A[k] = v
+}
+
+// has says whether l has the attribute k, or with -passthrough, whether
+// its object has the field
+func (l Log) has(k string) bool {
+	if _, ok := l.A[k]; ok || l.R == nil {
+		return ok
+	}
+	own := map[string]json.RawMessage{}
+	json.Unmarshal(l.R, &own)
+	_, ok := own[k]
+	return ok
+}
+
+func (l Log) MarshalJSON() ([]byte, error) {
+	type log Log
+	if l.R != nil {
+		return l.raw()
+	}
+	if len(l.A) == 0 {
+		return json.Marshal(log(l))
+	}
+	m := make(map[string]any, len(l.A)+2)
+	for k, v := range l.A {
+		m[k] = v
+	}
+	m["message"] = l.M
+	m["timestamp"] = l.T
+	return json.Marshal(m)
+}
+
+// raw returns R with the attributes and timestamp spliced in. the
+// object's own fields win, so none of them are there twice
+func (l Log) raw() ([]byte, error) {
+	own := map[string]json.RawMessage{}
+	json.Unmarshal(l.R, &own)
+	m := make(map[string]any, len(l.A)+1)
+	for k, v := range l.A {
+		if _, ok := own[k]; !ok {
+			m[k] = v
+		}
+	}
+	if _, ok := own["timestamp"]; !ok && l.T != 0 {
+		m["timestamp"] = l.T
+	}
+	if len(m) == 0 {
+		return l.R, nil
+	}
+	extra, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(l.R, []byte("{}")) {
+		return extra, nil
+	}
+	b := append([]byte{}, l.R[:len(l.R)-1]...)
+	b = append(b, ',')
+	return append(b, extra[1:]...), nil
+}
+
+func (l *Log) UnmarshalJSON(data []byte) error {
+	m := map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	*l = Log{}
+	if _, ok := m["message"]; !ok {
+		// from -passthrough, keep it that way
+		l.R = append(json.RawMessage{}, data...)
+		return nil
+	}
+	l.M, _ = m["message"].(string)
+	if n, ok := m["timestamp"].(json.Number); ok {
+		l.T, _ = n.Int64()
+	}
+	delete(m, "message")
+	delete(m, "timestamp")
+	if len(m) > 0 {
+		l.A = m
+	}
+	return nil
+}
+
+// kv is a repeatable key=value flag
+type kv map[string]any
+
+func (m kv) String() string {
+	s := []string{}
+	for k, v := range m {
+		s = append(s, fmt.Sprint(k, "=", v))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (m kv) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("want key=value: %q", s)
+	}
+	m[k] = v
+	return nil
 }
 
 // for sizes, just overestimate, it doesn't matter
 
 func (l Log) Len() int {
 	const hdr = `{"message":"","timestamp":1684206341000000000}`
-	return len(hdr) + len(l.M)*2 // assume the message is escaped
+	n := len(hdr) + len(l.M)*2 + len(l.R) // assume the message is escaped
+	for k, v := range l.A {
+		n += attrlen(k, v)
+	}
+	return n
+}
+
+func attrlen(k string, v any) int {
+	const hdr = `,"":`
+	switch v := v.(type) {
+	case string:
+		return len(hdr) + (len(k)+len(v)+2)*2
+	case json.RawMessage:
+		return len(hdr) + len(k)*2 + len(v) // already json, no need to marshal it
+	}
+	return len(hdr) + (len(k)+len(js(v)))*2
 }
 
 func (b Box) Len() (n int) {
 	for _, v := range b.Log {
 		n += v.Len()
 	}
-	return n + 32
+	return n + 32 + b.Common.Len()
+}
+
+func (c *Common) Len() (n int) {
+	if c == nil {
+		return 0
+	}
+	const hdr = `"common":{"attributes":{}},`
+	for k, v := range c.A {
+		n += attrlen(k, v)
+	}
+	return n + len(hdr)
+}
+
+// auth is the value of the -authheader header
+func auth(key string) string {
+	if *authpfx == "" {
+		return key
+	}
+	return *authpfx + " " + key
+}
+
+// payload is the request body for box, wrapped as -wrap says, or made
+// with the -template
+func payload(box Box) []byte {
+	if tmpl != nil {
+		return render(box)
+	}
+	switch *wrap {
+	case "object":
+		return []byte(js(box))
+	case "ndjson":
+		// no common block, so each log gets the attributes itself
+		b := []byte{}
+		for _, l := range box.Log {
+			b = append(b, js(inline(l, box.Common))...)
+			b = append(b, '\n')
+		}
+		return b
+	}
+	return []byte("[" + js(box) + "]")
+}
+
+// inline returns l with the common attributes it doesnt have already. l's
+// own attributes may be shared with other boxes, so they are copied
+func inline(l Log, c *Common) Log {
+	if c == nil {
+		return l
+	}
+	a := make(map[string]any, len(l.A)+len(c.A))
+	for k, v := range c.A {
+		a[k] = v
+	}
+	for k, v := range l.A {
+		a[k] = v
+	}
+	l.A = a
+	return l
+}
+
+// contenttype is the Content-Type of the payload
+func contenttype() string {
+	switch {
+	case *ctype != "":
+		return *ctype
+	case *wrap == "ndjson":
+		return "application/x-ndjson"
+	}
+	return "application/json"
 }
 
 func js(v any) string {
@@ -214,9 +2131,73 @@ func js(v any) string {
 	return string(d)
 }
 
+func warn(f string, v ...any) {
+	diag("warn", nil, f, v...)
+}
+
+// fatal prints the error and exits
+func fatal(f string, v ...any) {
+	stdout.flush()
+	diag("error", nil, f, v...)
+	os.Exit(1)
+}
+
+// stdout is where lines are echoed, and -emit payload writes. it is
+// buffered, and flushed along with the boxes, unless -flushstdout
+var stdout = &output{w: bufio.NewWriterSize(os.Stdout, 64<<10)}
+
+type output struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+func (o *output) println(b []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.w.Write(b)
+	o.w.WriteByte('\n')
+	if *flushstdout {
+		o.w.Flush()
+	}
+}
+
+func (o *output) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.w.Flush()
+}
+
+// info is for events a program watching logpipe wants to know about, it
+// only prints with -logjson, or -debug
+func info(fields map[string]any, f string, v ...any) {
+	if *logjson || *debug {
+		diag("info", fields, f, v...)
+	}
+}
+
 func dbg(f string, v ...any) {
 	if *debug {
-		fmt.Fprintf(os.Stderr, f, v...)
-		fmt.Fprintln(os.Stderr)
+		diag("debug", nil, f, v...)
+	}
+}
+
+// diag prints one of logpipe's own messages to stderr. with -logjson, it
+// is a json object with the level, the message and any fields
+func diag(level string, fields map[string]any, f string, v ...any) {
+	msg := fmt.Sprintf(f, v...)
+	if !*logjson {
+		if level != "debug" {
+			msg = "logpipe: " + msg
+		}
+		fmt.Fprintln(os.Stderr, msg)
+		return
+	}
+	m := map[string]any{}
+	for k, v := range fields {
+		m[k] = v
 	}
+	m["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	m["level"] = level
+	m["msg"] = msg
+	os.Stderr.WriteString(js(m) + "\n")
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSink starts a server that answers each push with the next of codes,
+// and the last one forever after. it returns the server and the boxes
+// it was sent
+func testSink(t *testing.T, codes ...int) (*httptest.Server, *[]Box) {
+	t.Helper()
+	var n int32
+	boxes := &[]Box{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Api-Key"); got != "key" {
+			t.Errorf("Api-Key: have %q, want %q", got, "key")
+		}
+		b := []Box{}
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil || len(b) != 1 {
+			t.Errorf("bad payload: %v", err)
+		}
+		*boxes = append(*boxes, b...)
+		i := int(atomic.AddInt32(&n, 1)) - 1
+		if i >= len(codes) {
+			i = len(codes) - 1
+		}
+		if codes[i] == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "7")
+		}
+		w.WriteHeader(codes[i])
+	}))
+	t.Cleanup(srv.Close)
+	return srv, boxes
+}
+
+func testBox(msg ...string) Box {
+	box := Box{}
+	for _, m := range msg {
+		box.Log = append(box.Log, Log{M: m, T: 1700000000000})
+	}
+	return box
+}
+
+func TestPush(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		code  int
+		want  error
+		after time.Duration
+	}{
+		{"accepted", http.StatusAccepted, nil, 0},
+		{"unavailable", http.StatusServiceUnavailable, &statusError{}, 7 * time.Second},
+		{"throttled", http.StatusTooManyRequests, &statusError{}, 0},
+		{"forbidden", http.StatusForbidden, errLicense, 0},
+		{"unauthorized", http.StatusUnauthorized, errLicense, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, boxes := testSink(t, tc.code)
+			err := push(srv.Client(), endpoint{url: srv.URL, key: "key"}, testBox("a", "b"))
+			var se *statusError
+			switch {
+			case tc.want == nil && err != nil:
+				t.Fatalf("have %v, want no error", err)
+			case tc.want == errLicense && !errors.Is(err, errLicense):
+				t.Fatalf("have %v, want %v", err, errLicense)
+			case tc.want != nil && tc.want != errLicense && !errors.As(err, &se):
+				t.Fatalf("have %v, want a *statusError", err)
+			}
+			if se != nil && se.after != tc.after {
+				t.Errorf("retry-after: have %s, want %s", se.after, tc.after)
+			}
+			if len(*boxes) != 1 || len((*boxes)[0].Log) != 2 || (*boxes)[0].Log[1].M != "b" {
+				t.Errorf("server got %v, want the box", *boxes)
+			}
+		})
+	}
+}
+
+func TestPushTransport(t *testing.T) {
+	srv, _ := testSink(t, http.StatusAccepted)
+	srv.Close()
+	err := push(srv.Client(), endpoint{url: srv.URL, key: "key"}, testBox("a"))
+	var se *statusError
+	if err == nil || errors.As(err, &se) || errors.Is(err, errLicense) {
+		t.Fatalf("have %v, want a transport error", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ids := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Request-Id"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ep := endpoint{url: srv.URL, key: "key"}
+	err1, err2 := push(srv.Client(), ep, testBox("a")), push(srv.Client(), ep, testBox("a"))
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if len(ids) != 2 || !uuid.MatchString(ids[0]) || ids[0] == ids[1] {
+		t.Fatalf("have ids %q, want two different uuids", ids)
+	}
+	var se *statusError
+	if !errors.As(err1, &se) || !strings.Contains(err1.Error(), ids[0]) || !strings.Contains(err2.Error(), ids[1]) {
+		t.Errorf("have %v and %v, want a *statusError saying the id", err1, err2)
+	}
+}
+
+func TestPushUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "fwd.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip(err)
+	}
+	path := ""
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+	})}}
+	srv.Start()
+	defer srv.Close()
+	ep := endpoint{url: "unix://" + sock, key: "key"}
+	ep.sock = unixClient(http.DefaultClient, sockpath(ep.url))
+	if err := push(http.DefaultClient, ep, testBox("a")); err != nil || path != "/log/v1" {
+		t.Fatalf("have %v, pushed to %q, want /log/v1", err, path)
+	}
+}
+
+func TestPushHTTP2(t *testing.T) {
+	defer func(c string) { *cacert = c }(*cacert)
+	proto := ""
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	*cacert = filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(*cacert, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := push(c, endpoint{url: srv.URL, key: "key"}, testBox("a")); err != nil || proto != "HTTP/2.0" {
+		t.Fatalf("have %v, pushed with %q, want HTTP/2.0", err, proto)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(r int, b time.Duration) { *retries, *maxback = r, b }(*retries, *maxback)
+	*maxback = time.Millisecond
+	for _, tc := range []struct {
+		name    string
+		retries int
+		codes   []int
+		pushes  int
+		ok      bool
+	}{
+		{"first", 3, []int{202}, 1, true},
+		{"third", 3, []int{500, 500, 202}, 3, true},
+		{"giveup", 2, []int{500}, 3, false},
+		{"noretries", 0, []int{500}, 1, false},
+		{"badkey", 3, []int{403}, 1, false},
+		{"badrequest", 3, []int{400}, 1, false},
+		{"toolarge", 3, []int{413}, 1, false},
+		{"throttled", 3, []int{429, 429, 202}, 3, true},
+		{"timeout", 3, []int{408, 202}, 2, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*retries = tc.retries
+			srv, boxes := testSink(t, tc.codes...)
+			err := retry(srv.Client(), endpoint{url: srv.URL, key: "key"}, testBox("a"))
+			if (err == nil) != tc.ok {
+				t.Errorf("have %v, want ok=%v", err, tc.ok)
+			}
+			if len(*boxes) != tc.pushes {
+				t.Errorf("have %d pushes, want %d", len(*boxes), tc.pushes)
+			}
+		})
+	}
+}
+
+func TestSplitBox(t *testing.T) {
+	const max = 2000
+	long := strings.Repeat("x", 5000)
+	for _, tc := range []struct {
+		name  string
+		msg   []string
+		boxes int
+	}{
+		{"empty", nil, 0},
+		{"one", []string{"a"}, 1},
+		{"fits", []string{"a", "b", "c"}, 1},
+		{"many", strings.Split(strings.Repeat("0123456789,", 100), ","), 4},
+		{"long", []string{"a", long, "b"}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			boxes := splitBox(testBox(tc.msg...), max)
+			if len(boxes) != tc.boxes {
+				t.Errorf("have %d boxes, want %d", len(boxes), tc.boxes)
+			}
+			var got []string
+			for _, b := range boxes {
+				if b.Len() > max {
+					t.Errorf("box is %d bytes, over %d", b.Len(), max)
+				}
+				if p := len(payload(b)); p > max {
+					t.Errorf("payload is %d bytes, over %d", p, max)
+				}
+				for _, l := range b.Log {
+					got = append(got, l.M)
+				}
+			}
+			if len(got) != len(tc.msg) {
+				t.Fatalf("have %d lines, want %d", len(got), len(tc.msg))
+			}
+			for i := range got {
+				if got[i] != tc.msg[i] && !(tc.msg[i] == long && strings.HasSuffix(got[i], truncated)) {
+					t.Errorf("line %d: have %.20q, want %.20q", i, got[i], tc.msg[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLogLen(t *testing.T) {
+	for _, line := range []string{
+		`{"message":"a","n":1,"meta":{"a":[1,2,3],"b":"x\"y"}}`,
+		`{"message":"a","s":"\u00e9\n"}`,
+		"plain \"quoted\" line",
+	} {
+		l, _ := parse([]byte(line))
+		b, _ := json.Marshal(l)
+		if l.Len() < len(b) {
+			t.Errorf("%s: Len is %d, under the %d bytes it marshals to", line, l.Len(), len(b))
+		}
+	}
+}
+
+func TestPayload(t *testing.T) {
+	defer func(w string) { *wrap = w }(*wrap)
+	box := testBox("a", "b")
+	box.Log[1].Set("env", "dev")
+	box.Common = &Common{A: map[string]any{"env": "prod", "app": "x"}}
+	for _, tc := range []struct{ wrap, want string }{
+		{"array", `[{"common":{"attributes":{"app":"x","env":"prod"}},"logs":[{"message":"a","timestamp":1700000000000},{"env":"dev","message":"b","timestamp":1700000000000}]}]`},
+		{"object", `{"common":{"attributes":{"app":"x","env":"prod"}},"logs":[{"message":"a","timestamp":1700000000000},{"env":"dev","message":"b","timestamp":1700000000000}]}`},
+		{"ndjson", `{"app":"x","env":"prod","message":"a","timestamp":1700000000000}` + "\n" + `{"app":"x","env":"dev","message":"b","timestamp":1700000000000}` + "\n"},
+	} {
+		*wrap = tc.wrap
+		if have := string(payload(box)); have != tc.want {
+			t.Errorf("%s:\nhave %s\nwant %s", tc.wrap, have, tc.want)
+		}
+	}
+	if box.Log[0].A != nil {
+		t.Errorf("ndjson changed the box: %v", box.Log[0].A)
+	}
+
+	var err error
+	defer func() { tmpl = nil }()
+	if tmpl, err = parseTemplate(`{{range .Logs}}{{.env}} {{json .message}} {{.timestamp}};{{end}}{{.Common.app}}`); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(payload(box)), `prod "a" 1700000000000;dev "b" 1700000000000;x`; have != want {
+		t.Errorf("template:\nhave %s\nwant %s", have, want)
+	}
+}
+
+func TestDeliverTooLarge(t *testing.T) {
+	lines := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := []Box{}
+		json.NewDecoder(r.Body).Decode(&b)
+		switch {
+		case len(b[0].Log) > 1:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case b[0].Log[0].M == "bad":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			lines++
+		}
+	}))
+	defer srv.Close()
+	s := &sink{endpoint: endpoint{url: srv.URL, key: "key"}}
+	if have := deliver(s, testBox("a", "b", "c", "d", "e")); have != (tally{sent: 5}) || lines != 5 {
+		t.Errorf("have %d lines pushed, %+v, want all 5 pushed one by one", lines, have)
+	}
+	lines = 0
+	if have := deliver(s, testBox("a", "bad", "c")); have != (tally{sent: 2, refused: 1}) || lines != 2 {
+		t.Errorf("have %d lines pushed, %+v, want 2 pushed and 1 refused", lines, have)
+	}
+}
+
+func TestCatchup(t *testing.T) {
+	defer func(r int, b time.Duration) { *retries, *maxback = r, b }(*retries, *maxback)
+	*retries, *maxback = 1, time.Millisecond
+	for _, tc := range []struct {
+		name  string
+		spool bool
+		want  string
+	}{
+		{"spool", true, "spooled spooled spooled spooled unacked live"},
+		{"wal", false, "unacked unacked unacked unacked live"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, boxes := testSink(t, 500, 500, 500, 202)
+			s := &sink{endpoint: endpoint{url: srv.URL, key: "key"}, q: newQueue(0, false)}
+			if tc.spool {
+				sp, err := openSpool(filepath.Join(t.TempDir(), "spool"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sp.append(testBox("spooled"))
+				s.sp = sp
+			}
+			s.unacked = []Box{testBox("unacked")}
+			s.q.put(testBox("live"))
+			s.q.close()
+			ship(s)
+
+			have := []string{}
+			for _, b := range *boxes {
+				have = append(have, b.Log[0].M)
+			}
+			if strings.Join(have, " ") != tc.want {
+				t.Errorf("have pushes %q, want %q", have, tc.want)
+			}
+			if s.sp != nil && s.sp.len() != 0 {
+				t.Errorf("have %d boxes left in the spool, want none", s.sp.len())
+			}
+		})
+	}
+}
+
+func TestFiles(t *testing.T) {
+	defer func(z bool) { *gzipin = z }(*gzipin)
+	dir := t.TempDir()
+	write := func(name, data string, z bool) string {
+		path := filepath.Join(dir, name)
+		buf := &bytes.Buffer{}
+		if z {
+			zw := gzip.NewWriter(buf)
+			zw.Write([]byte(data))
+			zw.Close()
+		} else {
+			buf.WriteString(data)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, z := range []bool{false, true} {
+		*gzipin = z
+		r := &files{paths: []string{
+			write("a", "a1\na2\n", z),
+			write("b", "", z),
+			write("c", "c1\nc2", z),
+			write("d", "d1\n", z),
+		}}
+		have, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "a1\na2\nc1\nc2\nd1\n"; string(have) != want {
+			t.Errorf("gzipin=%v: have %q, want %q", z, have, want)
+		}
+	}
+	r := &files{paths: []string{write("e", "not gzipped\n", false)}}
+	*gzipin = true
+	if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), "isnt gzipped") {
+		t.Errorf("have %v, want the input isnt gzipped", err)
+	}
+}
+
+func TestDelim(t *testing.T) {
+	defer func(d byte, p bool) { delim, *nopartial = d, p }(delim, *nopartial)
+	for _, tc := range []struct {
+		delim, in string
+		partial   bool
+		want      []string
+	}{
+		{`\n`, "a\r\nb\nc", false, []string{"a", "b", "c"}},
+		{`\0`, "a\nb\x00c\x00\x00d", false, []string{"a\nb", "c", "", "d"}},
+		{`\0`, "a\x00b", true, []string{"a"}},
+		{`\x1e`, "a\x1eb\x1e", false, []string{"a", "b"}},
+		{",", "a,b", false, []string{"a", "b"}},
+	} {
+		var err error
+		if delim, err = parsedelim(tc.delim); err != nil {
+			t.Fatal(err)
+		}
+		*nopartial = tc.partial
+		lines, errc := scan(context.Background(), strings.NewReader(tc.in))
+		have := []string{}
+		for l := range lines {
+			have = append(have, string(l))
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(have) != fmt.Sprint(tc.want) || len(have) != len(tc.want) {
+			t.Errorf("-delim %s: %q: have %q, want %q", tc.delim, tc.in, have, tc.want)
+		}
+	}
+	for _, s := range []string{"ab", "é", `Ā`, `\q`} {
+		if _, err := parsedelim(s); err == nil {
+			t.Errorf("-delim %s: have no error", s)
+		}
+	}
+}
+
+func TestAligned(t *testing.T) {
+	at := func(s string) time.Time {
+		t, _ := time.Parse(time.RFC3339Nano, s)
+		return t
+	}
+	for _, tc := range []struct {
+		now  string
+		d    time.Duration
+		want time.Duration
+	}{
+		{"2024-01-01T10:00:03Z", 10 * time.Second, 7 * time.Second},
+		{"2024-01-01T10:00:09.5Z", 10 * time.Second, 500 * time.Millisecond},
+		{"2024-01-01T10:00:00Z", 10 * time.Second, 10 * time.Second},
+		{"2024-01-01T10:07:30Z", time.Minute, 30 * time.Second},
+	} {
+		if have := aligned(at(tc.now), tc.d); have != tc.want {
+			t.Errorf("%s every %s: have %s, want %s", tc.now, tc.d, have, tc.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics serves the stats in the prometheus text format
+type metrics struct {
+	srv   *http.Server
+	sinks []*sink
+}
+
+func serveMetrics(addr string, sinks []*sink) (*metrics, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &metrics{sinks: sinks}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.srv = &http.Server{Handler: mux}
+	go m.srv.Serve(ln)
+	dbg("metrics: serving on %s", ln.Addr())
+	return m, nil
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, v int64) {
+		fmt.Fprintf(w, "# HELP logpipe_%s %s\n# TYPE logpipe_%s %s\nlogpipe_%s %d\n", name, help, name, kind, name, v)
+	}
+	buffered := atomic.LoadInt64(&stats.pending)
+	for _, s := range m.sinks {
+		buffered += int64(s.q.bytes())
+	}
+	metric("lines_read_total", "counter", "Lines read from the input.", atomic.LoadInt64(&stats.lines))
+	metric("boxes_pushed_total", "counter", "Boxes pushed successfully.", atomic.LoadInt64(&stats.boxes))
+	metric("push_failures_total", "counter", "Push attempts that failed, including retries.", atomic.LoadInt64(&stats.failed))
+	metric("json_lines_total", "counter", "Lines parsed that were json objects.", atomic.LoadInt64(&stats.json))
+	metric("plain_lines_total", "counter", "Lines parsed that werent json objects.", atomic.LoadInt64(&stats.plain))
+	metric("blank_lines_total", "counter", "Blank lines skipped with -skipblank.", atomic.LoadInt64(&stats.blank))
+	metric("lines_pushed_total", "counter", "Lines pushed successfully.", atomic.LoadInt64(&stats.sent))
+	metric("lines_kept_total", "counter", "Lines not pushed, but spooled, written to -fallback, or left in the -wal.", atomic.LoadInt64(&stats.kept))
+	metric("lines_lost_total", "counter", "Lines refused, or dropped after retries or at shutdown.", atomic.LoadInt64(&stats.lost))
+	metric("bytes_sent_total", "counter", "Bytes sent in successful pushes.", atomic.LoadInt64(&stats.bytes))
+	metric("lines_blocked_total", "counter", "Lines that waited for room to be collected.", atomic.LoadInt64(&stats.blocked))
+	metric("lines_dropped_total", "counter", "Lines dropped with -drop or -overflow ring because there was no room.", atomic.LoadInt64(&stats.dropped))
+	metric("boxes_dropped_total", "counter", "Boxes dropped from a full -maxbuffer, oldest first, with -overflow ring.", atomic.LoadInt64(&stats.boxdrops))
+	if *ratekey != "" {
+		fmt.Fprintf(w, "# HELP logpipe_lines_ratelimited_total Lines over -ratelimit dropped, for each -ratekey value.\n# TYPE logpipe_lines_ratelimited_total counter\n")
+		for _, kc := range limits() {
+			fmt.Fprintf(w, "logpipe_lines_ratelimited_total{value=%q} %d\n", kc.key, kc.n)
+		}
+	}
+	last := 0.0
+	if t := atomic.LoadInt64(&stats.lastok); t != 0 {
+		last = float64(t) / 1e9
+	}
+	fmt.Fprintf(w, "# HELP logpipe_start_timestamp_seconds When logpipe started.\n# TYPE logpipe_start_timestamp_seconds gauge\nlogpipe_start_timestamp_seconds %.3f\n", float64(start.UnixNano())/1e9)
+	fmt.Fprintf(w, "# HELP logpipe_last_push_timestamp_seconds When the last successful push was, 0 if never.\n# TYPE logpipe_last_push_timestamp_seconds gauge\nlogpipe_last_push_timestamp_seconds %.3f\n", last)
+	metric("current_buffer_bytes", "gauge", "Estimated bytes collected or queued and not yet pushed.", buffered)
+	if *trip > 0 {
+		fmt.Fprintf(w, "# HELP logpipe_breaker_state The endpoint's -breaker: 0 closed, 1 open, 2 probing.\n# TYPE logpipe_breaker_state gauge\n")
+		for _, s := range m.sinks {
+			fmt.Fprintf(w, "logpipe_breaker_state{endpoint=%q} %d\n", s.url, s.br.state())
+		}
+	}
+}
+
+// close shuts the server down, it is fine to call on a nil metrics
+func (m *metrics) close() {
+	if m == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m.srv.Shutdown(ctx)
+}
+
+// health asks the logpipe serving metrics on addr how it is doing, for
+// -health, and prints OK or what's wrong with it. it's unhealthy when
+// its lines have waited -healthage for a push that went through, or it
+// holds -maxbuffer bytes of them. it returns the exit code
+func health(addr string) int {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	c := &http.Client{Timeout: *timeout, Transport: &http.Transport{}} // no proxy
+	resp, err := c.Get("http://" + addr + "/metrics")
+	if err != nil {
+		warn("health: %v", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		warn("health: %s", resp.Status)
+		return 1
+	}
+	v := map[string]float64{}
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		name, val, ok := strings.Cut(sc.Text(), " ")
+		if !ok || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			v[name] = f
+		}
+	}
+	if err := sc.Err(); err != nil {
+		warn("health: %v", err)
+		return 1
+	}
+	if _, ok := v["logpipe_current_buffer_bytes"]; !ok {
+		warn("health: %s isnt serving logpipe's metrics", addr)
+		return 1
+	}
+	buffered, last := v["logpipe_current_buffer_bytes"], v["logpipe_last_push_timestamp_seconds"]
+	if last == 0 {
+		last = v["logpipe_start_timestamp_seconds"]
+	}
+	since := time.Since(time.Unix(0, int64(last*1e9))).Round(time.Second)
+	switch {
+	case buffered > 0 && since > *healthage:
+		warn("health: no successful push in %s, %.0f bytes waiting", since, buffered)
+		return 1
+	case *maxbuffer > 0 && buffered >= float64(*maxbuffer):
+		warn("health: %.0f bytes buffered, -maxbuffer is %d", buffered, *maxbuffer)
+		return 1
+	}
+	fmt.Println("OK")
+	return 0
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// parse turns a line read from the input into a log. it returns false if
+// the line should be dropped
+func parse(line []byte) (Log, bool) {
+	l, ok := parseline(line)
+	if ok && tracere != nil {
+		l = traceids(l)
+	}
+	return l, ok
+}
+
+func parseline(line []byte) (Log, bool) {
+	if *logfmt {
+		if l, ok := parselogfmt(string(line)); ok {
+			count(&stats.plain, 1)
+			return leveled(l, nil), true
+		}
+	}
+	m := fields(line)
+	if m != nil {
+		count(&stats.json, 1)
+	} else {
+		count(&stats.plain, 1)
+	}
+	if *passthrough {
+		if m != nil {
+			return leveled(passed(line, m), m), true
+		}
+		if *strict {
+			dbg("passthrough: dropping %q", line)
+			return Log{}, false
+		}
+	}
+	ts := sane(stamp(m))
+	if m != nil && !*rawjson {
+		return leveled(promoted(line, m, ts), m), true
+	}
+	return leveled(newLog(string(line), ts), m), true
+}
+
+// promoted returns a log with the json object's fields as attributes,
+// and its -msgfield field as the message, message or msg by default.
+// without it, the message is the whole line. the -tsfield field is the
+// timestamp, so it isnt sent twice. with -keepraw, the line is the raw
+// attribute
+func promoted(line []byte, m map[string]json.RawMessage, ts int64) Log {
+	msg, from := string(line), ""
+	keys := []string{*msgfield}
+	if *msgfield == "message" {
+		keys = append(keys, "msg")
+	}
+	for _, k := range keys {
+		s := ""
+		if json.Unmarshal(m[k], &s) == nil && s != "" {
+			msg, from = s, k
+			break
+		}
+	}
+	l := newLog(msg, ts)
+	for k, v := range m {
+		if k != from && k != *tsfield && k != "timestamp" {
+			l.Set(k, v)
+		}
+	}
+	if *keepraw {
+		l.Set("raw", cut(string(line)))
+	}
+	return l
+}
+
+// passed returns a log that is the json object line, as it is. the
+// object's own fields win over attributes, and if it has no timestamp
+// of its own, one is added like for any other line
+func passed(line []byte, m map[string]json.RawMessage) Log {
+	l := newLog("", 0)
+	l.R = append(json.RawMessage{}, bytes.TrimSpace(line)...)
+	if _, ok := m["timestamp"]; !ok {
+		l.T = sane(stamp(m))
+	}
+	for k := range m {
+		delete(l.A, k)
+	}
+	return l
+}
+
+// fields returns the top level fields of a json object, or nil if the
+// line isnt one
+func fields(line []byte) (m map[string]json.RawMessage) {
+	if json.Unmarshal(line, &m) != nil {
+		return nil
+	}
+	return m
+}
+
+// stamp returns the timestamp under -tsfield as epoch milliseconds, or zero
+// if there isnt one
+func stamp(m map[string]json.RawMessage) int64 {
+	v, ok := lookup(m, *tsfield)
+	if !ok {
+		return 0
+	}
+	s := ""
+	if json.Unmarshal(v, &s) == nil {
+		return when(s)
+	}
+	return when(string(v))
+}
+
+// sane returns ts, or now if there is none, or with -tsclamp, if it is
+// further than that from now, so a producer with a broken clock doesnt
+// scatter its logs across the timeline
+func sane(ts int64) int64 {
+	now := time.Now().UnixMilli()
+	if ts == 0 {
+		return now
+	}
+	if d := time.Duration(now-ts) * time.Millisecond; *tsclamp > 0 && (d > *tsclamp || d < -*tsclamp) {
+		dbg("tsclamp: %s is %s from now, sending now instead", time.UnixMilli(ts).UTC().Format(time.RFC3339), d.Round(time.Second))
+		return now
+	}
+	return ts
+}
+
+// lookup returns the field at path in m, where a dotted path like
+// meta.time is the time field of the meta object. a field that is
+// named meta.time itself wins
+func lookup(m map[string]json.RawMessage, path string) (json.RawMessage, bool) {
+	if v, ok := m[path]; ok {
+		return v, true
+	}
+	k, rest, ok := strings.Cut(path, ".")
+	if !ok {
+		return nil, false
+	}
+	var sub map[string]json.RawMessage
+	if json.Unmarshal(m[k], &sub) != nil || sub == nil {
+		return nil, false
+	}
+	return lookup(sub, rest)
+}
+
+// tracere finds the trace and span ids in a line, see -traceregex
+var tracere *regexp.Regexp
+
+// traceids sets the trace.id and span.id attributes newrelic links a log
+// to its trace by, from the trace_id and span_id groups of tracere, unless
+// the log has them already
+func traceids(l Log) Log {
+	sm := tracere.FindStringSubmatch(text(l))
+	if sm == nil {
+		return l
+	}
+	for i, name := range tracere.SubexpNames() {
+		k := map[string]string{"trace_id": "trace.id", "span_id": "span.id"}[name]
+		if k == "" || sm[i] == "" || l.has(k) {
+			continue
+		}
+		l.Set(k, sm[i])
+	}
+	return l
+}
+
+// levelre finds the level in a plaintext line, see -levelregex
+var levelre = regexp.MustCompile(`\b(FATAL|ERROR|WARN|WARNING|INFO|DEBUG|TRACE)\b`)
+
+// leveled sets the level attribute of l with -level. a level field in the
+// json object m wins, otherwise it's the first submatch of levelre in
+// the message. a line with neither doesnt get one
+func leveled(l Log, m map[string]json.RawMessage) Log {
+	if !*levels {
+		return l
+	}
+	if _, ok := l.A["level"]; ok {
+		return l
+	}
+	if _, ok := attrs["level"]; ok {
+		return l // -attr level=... in the common block
+	}
+	for _, k := range []string{"level", "lvl", "severity"} {
+		s := ""
+		if json.Unmarshal(m[k], &s) == nil && s != "" {
+			l.Set("level", s)
+			return l
+		}
+	}
+	sm := levelre.FindStringSubmatch(l.M)
+	if sm == nil {
+		return l
+	}
+	lv := sm[0]
+	if len(sm) > 1 {
+		lv = sm[1]
+	}
+	if lv = strings.ToLower(lv); lv == "warning" {
+		lv = "warn"
+	}
+	if lv != "" {
+		l.Set("level", lv)
+	}
+	return l
+}
+
+// when returns the epoch milliseconds for an RFC3339 or numeric
+// timestamp, or zero if s is neither
+func when(s string) int64 {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UnixMilli()
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return millis(f, *tsunit)
+}
+
+// millis converts an epoch timestamp in unit to milliseconds. for "auto"
+// the unit is a guess: anything under 1e11 is seconds (thats the year 5138),
+// and each of ms, us and ns are a thousand times bigger than the last
+func millis(f float64, unit string) int64 {
+	if unit == "auto" {
+		switch a := math.Abs(f); {
+		case a < 1e11:
+			unit = "s"
+		case a < 1e14:
+			unit = "ms"
+		case a < 1e17:
+			unit = "us"
+		default:
+			unit = "ns"
+		}
+	}
+	switch unit {
+	case "s":
+		f *= 1e3
+	case "us":
+		f /= 1e3
+	case "ns":
+		f /= 1e6
+	}
+	return int64(f)
+}
+
+// parselogfmt parses a line of key=value pairs. values may be quoted
+// go style. it returns false unless every field in the line is a pair
+func parselogfmt(line string) (l Log, ok bool) {
+	l = newLog(line, 0)
+	s := strings.TrimSpace(line)
+	if s == "" {
+		return l, false
+	}
+	for s != "" {
+		eq := strings.IndexAny(s, "= \t\"")
+		if eq <= 0 || s[eq] != '=' {
+			return l, false
+		}
+		k, v := s[:eq], ""
+		s = s[eq+1:]
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(s) {
+				return l, false
+			}
+			uq, err := strconv.Unquote(s[:end+1])
+			if err != nil {
+				return l, false
+			}
+			v, s = uq, s[end+1:]
+			if s != "" && s[0] != ' ' && s[0] != '\t' {
+				return l, false
+			}
+		} else if sp := strings.IndexAny(s, " \t"); sp >= 0 {
+			v, s = s[:sp], s[sp:]
+		} else {
+			v, s = s, ""
+		}
+		s = strings.TrimLeft(s, " \t")
+		switch k {
+		case *tsfield:
+			l.T = when(v)
+		case "lvl", "severity":
+			l.Set("level", v)
+		default:
+			l.Set(k, v)
+		}
+	}
+	l.T = sane(l.T)
+	return l, true
+}
+
+// clip cuts l's message down to -maxmsg bytes, see cut
+func clip(l Log) Log {
+	l.M = cut(l.M)
+	return l
+}
+
+// cut cuts s down to -maxmsg bytes, at the start of a rune, and says how
+// many bytes it cut
+func cut(s string) string {
+	if *maxmsg <= 0 || len(s) <= *maxmsg {
+		return s
+	}
+	n := *maxmsg
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	dbg("clip: %d bytes to %d", len(s), n)
+	return fmt.Sprintf("%s…(truncated %d bytes)", s[:n], len(s)-n)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStamp(t *testing.T) {
+	const ms = 1700000000123
+	for _, tc := range []struct {
+		line string
+		want int64
+	}{
+		{`{"ts":1700000000.123}`, ms},
+		{`{"ts":1700000000123}`, ms},
+		{`{"ts":1700000000123000}`, ms},
+		{`{"ts":1700000000123000000}`, ms},
+		{`{"ts":"1700000000123"}`, ms},
+		{`{"ts":"2023-11-14T22:13:20.123Z"}`, ms},
+		{`{"ts":"2023-11-14T23:13:20.123+01:00"}`, ms},
+		{`{"ts":"yesterday"}`, 0},
+		{`{"time":1700000000}`, 0},
+		{`{"ts":null}`, 0},
+		{`not json`, 0},
+	} {
+		if have := stamp(fields([]byte(tc.line))); have != tc.want {
+			t.Errorf("%s: have %d, want %d", tc.line, have, tc.want)
+		}
+	}
+}
+
+func TestStampNow(t *testing.T) {
+	for _, line := range []string{"plain", `{"message":"no ts"}`, `{"ts":0}`} {
+		l, _ := parse([]byte(line))
+		sent := []struct{ Logs []Log }{}
+		if err := json.Unmarshal(payload(Box{Log: []Log{l}}), &sent); err != nil || len(sent) != 1 {
+			t.Fatalf("%s: bad payload: %v", line, err)
+		}
+		if d := time.Now().UnixMilli() - sent[0].Logs[0].T; d < 0 || d > 1000 {
+			t.Errorf("%s: sent a timestamp %dms from now, want within a second", line, d)
+		}
+	}
+}
+
+func TestStampUnit(t *testing.T) {
+	defer func(u string) { *tsunit = u }(*tsunit)
+	for _, tc := range []struct {
+		unit string
+		ts   string
+		want int64
+	}{
+		{"s", "1700000000", 1700000000000},
+		{"ms", "1700000000", 1700000000},
+		{"us", "1700000000", 1700000},
+		{"ns", "1700000000", 1700},
+		{"ms", "2023-11-14T22:13:20Z", 1700000000000},
+	} {
+		*tsunit = tc.unit
+		if have := when(tc.ts); have != tc.want {
+			t.Errorf("%s %s: have %d, want %d", tc.ts, tc.unit, have, tc.want)
+		}
+	}
+}
+
+func TestStampClamp(t *testing.T) {
+	defer func(d time.Duration) { *tsclamp = d }(*tsclamp)
+	now := time.Now()
+	for _, tc := range []struct {
+		clamp time.Duration
+		ts    time.Time
+		now   bool
+	}{
+		{0, now.Add(-24 * 365 * time.Hour), false},
+		{24 * time.Hour, now.Add(-time.Hour), false},
+		{24 * time.Hour, now.Add(23 * time.Hour), false},
+		{24 * time.Hour, now.Add(-25 * time.Hour), true},
+		{24 * time.Hour, now.Add(24 * 365 * time.Hour), true},
+		{24 * time.Hour, time.UnixMilli(1), true},
+	} {
+		*tsclamp = tc.clamp
+		line := fmt.Sprintf(`{"ts":%d,"message":"a"}`, tc.ts.UnixMilli())
+		l, _ := parse([]byte(line))
+		restamped := l.T != tc.ts.UnixMilli()
+		if restamped != tc.now || restamped && time.Since(time.UnixMilli(l.T)) > time.Minute {
+			t.Errorf("%s with -tsclamp %s: sent %s", tc.ts, tc.clamp, time.UnixMilli(l.T))
+		}
+	}
+}
+
+func TestStampField(t *testing.T) {
+	defer func(f string) { *tsfield = f }(*tsfield)
+	*tsfield = "time"
+	l, ok := parse([]byte(`{"time":1700000000,"ts":5,"msg":"hi"}`))
+	if !ok || l.T != 1700000000000 {
+		t.Fatalf("have %d, want the time field", l.T)
+	}
+	if l.M != "hi" {
+		t.Errorf("message: have %q, want %q", l.M, "hi")
+	}
+}
+
+func TestStampPath(t *testing.T) {
+	defer func(f string) { *tsfield = f }(*tsfield)
+	*tsfield = "meta.time"
+	for _, tc := range []struct {
+		line string
+		want int64
+	}{
+		{`{"meta":{"time":1700000000}}`, 1700000000000},
+		{`{"meta.time":1700000001,"meta":{"time":1700000000}}`, 1700000001000},
+		{`{"meta":{"when":1700000000}}`, 0},
+		{`{"meta":"1700000000"}`, 0},
+		{`{"time":1700000000}`, 0},
+	} {
+		if have := stamp(fields([]byte(tc.line))); have != tc.want {
+			t.Errorf("%s: have %d, want %d", tc.line, have, tc.want)
+		}
+	}
+}
+
+func TestPassthroughLevel(t *testing.T) {
+	defer func(p, l bool) { *passthrough, *levels = p, l }(*passthrough, *levels)
+	*passthrough, *levels = true, true
+	for _, tc := range []struct{ line, want string }{
+		{`{"level":"error","msg":"x"}`, `"level":"error"`},
+		{`{"lvl":"warn","msg":"x"}`, `"level":"warn"`},
+		{`{"msg":"x","timestamp":5}`, `"timestamp":5`},
+	} {
+		l, _ := parse([]byte(tc.line))
+		b, err := l.raw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		k, _, _ := strings.Cut(tc.want, ":")
+		if !strings.Contains(string(b), tc.want) || strings.Count(string(b), k) != 1 {
+			t.Errorf("%s: sent %s, want %s once", tc.line, b, tc.want)
+		}
+	}
+}
+
+func TestMsgField(t *testing.T) {
+	defer func(f string) { *msgfield = f }(*msgfield)
+	for _, tc := range []struct{ field, line, want string }{
+		{"message", `{"message":"a","msg":"b"}`, "a"},
+		{"message", `{"msg":"b"}`, "b"},
+		{"event", `{"event":"c","message":"a"}`, "c"},
+		{"event", `{"msg":"b"}`, `{"msg":"b"}`},
+	} {
+		*msgfield = tc.field
+		l, _ := parse([]byte(tc.line))
+		if l.M != tc.want {
+			t.Errorf("-msgfield %s: %s: have %q, want %q", tc.field, tc.line, l.M, tc.want)
+		}
+	}
+}
+
+func TestKeepRaw(t *testing.T) {
+	defer func(b bool, n int) { *keepraw, *maxmsg = b, n }(*keepraw, *maxmsg)
+	*keepraw = true
+	for _, tc := range []struct {
+		max        int
+		line, want string
+	}{
+		{0, `{"msg":"a", "n": 1}`, `{"msg":"a", "n": 1}`},
+		{8, `{"msg":"a", "n": 1}`, `{"msg":"…(truncated 11 bytes)`},
+	} {
+		*maxmsg = tc.max
+		l, _ := parse([]byte(tc.line))
+		if l.M != "a" || l.A["raw"] != tc.want {
+			t.Errorf("%s: have %q and raw %q, want %q", tc.line, l.M, l.A["raw"], tc.want)
+		}
+	}
+}
+
+func TestTraceIDs(t *testing.T) {
+	defer func(re *regexp.Regexp) { tracere = re }(tracere)
+	tracere = regexp.MustCompile(`trace=(?P<trace_id>\w+)( span=(?P<span_id>\w+))?`)
+	for _, tc := range []struct{ line, trace, span string }{
+		{"GET / trace=abc span=def", "abc", "def"},
+		{"GET / trace=abc", "abc", ""},
+		{"GET /", "", ""},
+		{`{"msg":"trace=abc span=def","trace.id":"xyz"}`, "xyz", "def"},
+	} {
+		l, _ := parse([]byte(tc.line))
+		trace, _ := l.A["trace.id"].(string)
+		if raw, ok := l.A["trace.id"].(json.RawMessage); ok {
+			json.Unmarshal(raw, &trace)
+		}
+		span, _ := l.A["span.id"].(string)
+		if trace != tc.trace || span != tc.span {
+			t.Errorf("%s: have trace.id %q span.id %q, want %q %q", tc.line, trace, span, tc.trace, tc.span)
+		}
+	}
+
+	defer func(p bool) { *passthrough = p }(*passthrough)
+	*passthrough = true
+	line := `{"trace.id":"own","msg":"trace=abc span=def"}`
+	l, _ := parse([]byte(line))
+	b, _ := l.raw()
+	if strings.Count(string(b), `"trace.id"`) != 1 || !strings.Contains(string(b), `"trace.id":"own"`) || !strings.Contains(string(b), `"span.id":"def"`) {
+		t.Errorf("passthrough %s: sent %s, want its own trace.id, and span.id def", line, b)
+	}
+}
+
+func TestClip(t *testing.T) {
+	defer func(n int) { *maxmsg = n }(*maxmsg)
+	*maxmsg = 5
+	for _, tc := range []struct{ m, want string }{
+		{"", ""},
+		{"hello", "hello"},
+		{"hello world", "hello…(truncated 6 bytes)"},
+		{"héllo", "héll…(truncated 1 bytes)"},
+		{"hélló", "héll…(truncated 2 bytes)"},
+		{"日本語", "日…(truncated 6 bytes)"},
+	} {
+		if have := clip(Log{M: tc.m}).M; have != tc.want {
+			t.Errorf("%q: have %q, want %q", tc.m, have, tc.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// queue is a fifo of boxes waiting to be pushed. the collector puts boxes
+// here and moves on, so a slow or retrying push never stops it from
+// reading linec, until the queue holds -maxbuffer bytes
+type queue struct {
+	mu     sync.Mutex
+	cond   sync.Cond
+	box    []Box
+	size   int // bytes put and not done with yet
+	max    int // size put waits below, or 0 for no limit
+	drop   bool
+	warned time.Time
+	closed bool
+	forget func(Box)      // called on the boxes drop drops, if set
+	spill  func(Box) bool // if set, takes the overflow instead, see overflow
+}
+
+// newQueue returns a queue holding up to max bytes. once it's full, put
+// blocks until there's room, or with drop, drops the oldest boxes queued
+// to make some, like a ring buffer
+func newQueue(max int, drop bool) *queue {
+	q := &queue{max: max, drop: drop}
+	q.cond.L = &q.mu
+	return q
+}
+
+func (q *queue) put(b Box) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.max > 0 && q.size > 0 && q.size+b.Len() > q.max {
+		if q.spill != nil && q.overflow(b) {
+			return
+		}
+		if !q.drop && quit.Err() == nil {
+			q.cond.Wait()
+			continue
+		}
+		if !q.drop {
+			break // out of time, the pusher drops it, or spools it
+		}
+		if len(q.box) == 0 {
+			break // only the one being pushed is left, let it finish
+		}
+		old := q.box[0]
+		q.box[0] = Box{}
+		q.box = q.box[1:]
+		q.size -= old.Len()
+		count(&stats.dropped, len(old.Log))
+		count(&stats.boxdrops, 1)
+		if q.forget != nil {
+			q.forget(old)
+		}
+		if time.Since(q.warned) > 10*time.Second {
+			q.warned = time.Now()
+			warn("buffer: -maxbuffer is full, dropping the oldest lines")
+		}
+	}
+	q.box = append(q.box, b)
+	q.size += b.Len()
+	q.cond.Broadcast()
+}
+
+// overflow hands the boxes waiting, oldest first, and then b, to spill,
+// so that they stay in order, and says whether b went too. if spill
+// fails, what is left waits as usual
+func (q *queue) overflow(b Box) bool {
+	for len(q.box) > 0 {
+		if !q.spill(q.box[0]) {
+			return false
+		}
+		q.size -= q.box[0].Len()
+		q.box[0] = Box{}
+		q.box = q.box[1:]
+	}
+	if !q.spill(b) {
+		return false
+	}
+	if time.Since(q.warned) > 10*time.Second {
+		q.warned = time.Now()
+		warn("buffer: -maxbuffer is full, spooling the lines waiting")
+	}
+	return true
+}
+
+// get blocks until there is a box to push. it returns false once the
+// queue is closed and there is nothing left in it. the box counts toward
+// the queue's size until it is passed to done
+func (q *queue) get() (Box, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.box) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.box) == 0 {
+		return Box{}, false
+	}
+	b := q.box[0]
+	q.box[0] = Box{}
+	q.box = q.box[1:]
+	return b, true
+}
+
+// done is called when the pusher is finished with b, one way or another
+func (q *queue) done(b Box) {
+	q.mu.Lock()
+	q.size -= b.Len()
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// bytes returns the size of the boxes in the queue, or being pushed
+func (q *queue) bytes() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// wake gets a put waiting on a full queue to look at quit again, it's
+// called once quit is canceled
+func (q *queue) wake() {
+	q.mu.Lock()
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueDrop(t *testing.T) {
+	b := testBox("a", "b")
+	q := newQueue(2*b.Len(), true)
+	dropped := atomic.LoadInt64(&stats.boxdrops)
+	for _, m := range []string{"1", "2", "3", "4"} {
+		q.put(testBox(m, m))
+	}
+	if n := atomic.LoadInt64(&stats.boxdrops) - dropped; n != 2 {
+		t.Errorf("have %d boxes dropped, want 2", n)
+	}
+	if q.bytes() > 2*b.Len() {
+		t.Errorf("queue holds %d bytes, over %d", q.bytes(), 2*b.Len())
+	}
+	q.close()
+	have := ""
+	for b, ok := q.get(); ok; b, ok = q.get() {
+		have += b.Log[0].M
+		q.done(b)
+	}
+	if have != "34" {
+		t.Errorf("have boxes %q, want the newest, %q", have, "34")
+	}
+}
+
+func TestQueueSpill(t *testing.T) {
+	b := testBox("a", "b")
+	q := newQueue(b.Len(), false)
+	spilled, ok := "", true
+	q.spill = func(b Box) bool {
+		if ok {
+			spilled += b.Log[0].M
+		}
+		return ok
+	}
+	q.put(testBox("1", "1"))
+	first, _ := q.get() // being pushed
+	for _, m := range []string{"2", "3", "4"} {
+		q.put(testBox(m, m))
+	}
+	if spilled != "234" || q.bytes() != first.Len() {
+		t.Errorf("spilled %q, holding %d bytes, want 234 and only the box being pushed", spilled, q.bytes())
+	}
+	ok = false
+	put := make(chan bool)
+	go func() {
+		q.put(testBox("5", "5"))
+		close(put)
+	}()
+	select {
+	case <-put:
+		t.Fatal("put didnt block once spill failed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.done(first)
+	<-put
+	q.close()
+	have := ""
+	for b, ok := q.get(); ok; b, ok = q.get() {
+		have += b.Log[0].M
+		q.done(b)
+	}
+	if have != "5" {
+		t.Errorf("have boxes %q, want 5", have)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	b := testBox("a")
+	q := newQueue(b.Len(), false)
+	q.put(b)
+	put := make(chan bool)
+	go func() {
+		q.put(b)
+		close(put)
+	}()
+	select {
+	case <-put:
+		t.Fatal("put didnt block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	got, _ := q.get()
+	q.done(got)
+	select {
+	case <-put:
+	case <-time.After(time.Second):
+		t.Fatal("put still blocked after done")
+	}
+}
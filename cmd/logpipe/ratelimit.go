@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiter drops the lines over -ratelimit for each value of the -ratekey
+// attribute, so one noisy service cant crowd the rest out. each value has
+// a token bucket holding the whole budget, refilled over the window. lines
+// without the attribute share one bucket. a nil limiter keeps every line
+type limiter struct {
+	attr    string
+	every   rate.Limit
+	burst   int
+	buckets map[string]*rate.Limiter
+}
+
+// maxkeys is how many values have a bucket at once. past it, the buckets
+// that are full again are forgotten, they would let the next line through
+// anyway
+const maxkeys = 10000
+
+// newLimiter parses a -ratelimit like 100/1s or 6000/1m
+func newLimiter(attr, s string) (*limiter, error) {
+	if attr == "" {
+		return nil, nil
+	}
+	n, per, ok := strings.Cut(s, "/")
+	lines, err := strconv.Atoi(n)
+	if !ok || err != nil || lines < 1 {
+		return nil, fmt.Errorf("%q, want lines/window, like 100/1s", s)
+	}
+	win, err := time.ParseDuration(per)
+	if err != nil || win <= 0 {
+		return nil, fmt.Errorf("%q, want lines/window, like 100/1s", s)
+	}
+	return &limiter{
+		attr:    attr,
+		every:   rate.Every(win / time.Duration(lines)),
+		burst:   lines,
+		buckets: map[string]*rate.Limiter{},
+	}, nil
+}
+
+// allow says whether l is within its value's budget, and counts it if not.
+// only the scanner calls it
+func (r *limiter) allow(l Log) bool {
+	if r == nil {
+		return true
+	}
+	k := r.key(l)
+	b := r.buckets[k]
+	if b == nil {
+		if len(r.buckets) >= maxkeys {
+			r.sweep()
+		}
+		b = rate.NewLimiter(r.every, r.burst)
+		r.buckets[k] = b
+	}
+	if b.Allow() {
+		return true
+	}
+	if limit(k) == 1 {
+		warn("ratelimit: %s=%q is over -ratelimit, dropping its lines", r.attr, k)
+	}
+	return false
+}
+
+// key is l's value of the attribute, or the -attr one, or empty
+func (r *limiter) key(l Log) string {
+	if v, ok := l.A[r.attr]; ok {
+		return attrstr(v)
+	}
+	if v, ok := attrs[r.attr]; ok {
+		return attrstr(v)
+	}
+	return ""
+}
+
+// sweep forgets the full buckets, or all of them if none are, which lets
+// a little too much through until they empty again
+func (r *limiter) sweep() {
+	for k, b := range r.buckets {
+		if b.Tokens() >= float64(r.burst) {
+			delete(r.buckets, k)
+		}
+	}
+	if len(r.buckets) >= maxkeys {
+		r.buckets = map[string]*rate.Limiter{}
+	}
+}
+
+// limited counts the lines -ratelimit dropped, for each -ratekey value
+var limited = struct {
+	sync.Mutex
+	n map[string]int64
+}{n: map[string]int64{}}
+
+// limit counts another line of k dropped, and returns how many have been.
+// past maxkeys values, the rest are counted together under "other"
+func limit(k string) int64 {
+	limited.Lock()
+	defer limited.Unlock()
+	if _, ok := limited.n[k]; !ok && len(limited.n) >= maxkeys {
+		k = "other"
+	}
+	limited.n[k]++
+	return limited.n[k]
+}
+
+// keycount is the lines dropped for one -ratekey value
+type keycount struct {
+	key string
+	n   int64
+}
+
+// limits returns the lines dropped for each value, most first
+func limits() []keycount {
+	limited.Lock()
+	defer limited.Unlock()
+	kc := make([]keycount, 0, len(limited.n))
+	for k, n := range limited.n {
+		kc = append(kc, keycount{k, n})
+	}
+	sort.Slice(kc, func(i, j int) bool {
+		if kc[i].n != kc[j].n {
+			return kc[i].n > kc[j].n
+		}
+		return kc[i].key < kc[j].key
+	})
+	return kc
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	for _, bad := range []string{"", "100", "0/1s", "x/1s", "100/", "100/0s", "100/-1s"} {
+		if _, err := newLimiter("service", bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+	if r, err := newLimiter("", "junk"); r != nil || err != nil {
+		t.Fatalf("no -ratekey: %v, %v", r, err)
+	}
+
+	defer func() { limited.n = map[string]int64{} }()
+	r, err := newLimiter("service", "3/1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := map[string]int{}
+	for i := 0; i < 5; i++ {
+		for _, line := range []string{
+			`{"service":"a","message":"x"}`,
+			`{"service":"b","message":"x"}`,
+			`{"message":"x"}`,
+			`plain`,
+		} {
+			l, _ := parse([]byte(line))
+			if r.allow(l) {
+				kept[r.key(l)]++
+			}
+		}
+	}
+	want := map[string]int{"a": 3, "b": 3, "": 3}
+	for k, n := range want {
+		if kept[k] != n {
+			t.Errorf("%q: kept %d, want %d", k, kept[k], n)
+		}
+	}
+	have := limits()
+	if len(have) != 3 || have[0] != (keycount{"", 7}) || have[1] != (keycount{"a", 2}) {
+		t.Errorf("limits: %v", have)
+	}
+}
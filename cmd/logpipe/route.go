@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// route sends the logs it matches to one endpoint, instead of the others
+type route struct {
+	to     string          // name of the endpoint
+	levels map[string]bool // level attributes matched, lowercase
+	re     *regexp.Regexp  // matches the message, if not nil
+}
+
+// routes is the repeatable -route flag
+type routes []route
+
+func (r *routes) String() string {
+	s := []string{}
+	for _, rt := range *r {
+		s = append(s, rt.to)
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parses to=name and level=a|b or match=regexp. a regexp may have
+// commas in it, anything after one that isnt another field is part of it
+func (r *routes) Set(s string) error {
+	rt := route{}
+	fields := []string{}
+	for _, f := range strings.Split(s, ",") {
+		k, _, _ := strings.Cut(f, "=")
+		if len(fields) > 0 && k != "to" && k != "level" && k != "match" {
+			fields[len(fields)-1] += "," + f
+			continue
+		}
+		fields = append(fields, f)
+	}
+	for _, f := range fields {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return fmt.Errorf("want to=...,level=... or to=...,match=...: %q", s)
+		}
+		switch k {
+		case "to":
+			rt.to = v
+		case "level":
+			rt.levels = map[string]bool{}
+			for _, lv := range strings.Split(v, "|") {
+				rt.levels[strings.ToLower(lv)] = true
+			}
+		case "match":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return err
+			}
+			rt.re = re
+		default:
+			return fmt.Errorf("unknown route field: %q", k)
+		}
+	}
+	if rt.to == "" {
+		return fmt.Errorf("route has no endpoint: %q", s)
+	}
+	if rt.levels == nil && rt.re == nil {
+		return fmt.Errorf("route matches nothing, give it a level or match: %q", s)
+	}
+	*r = append(*r, rt)
+	return nil
+}
+
+// match says whether l goes down this route. with both a level and a
+// regexp, it must match both
+func (rt route) match(l Log) bool {
+	if rt.levels != nil && !rt.levels[strings.ToLower(attrstr(l.A["level"]))] {
+		return false
+	}
+	if rt.re != nil {
+		return rt.re.MatchString(text(l))
+	}
+	return true
+}
+
+// text is what a regexp sees of l, the message or with -passthrough the
+// whole line
+func text(l Log) string {
+	if l.R != nil {
+		return string(l.R)
+	}
+	return l.M
+}
+
+// attrstr returns an attribute as a string. promoted json fields are
+// still json
+func attrstr(v any) string {
+	if raw, ok := v.(json.RawMessage); ok {
+		s := ""
+		if json.Unmarshal(raw, &s) == nil {
+			return s
+		}
+		return string(raw)
+	}
+	return fmt.Sprint(v)
+}
+
+// routeof returns which box l goes in: one more than the index of the
+// first route it matches, or 0 if it matches none
+func routeof(l Log) int {
+	for i, rt := range rules {
+		if rt.match(l) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// dests returns the sinks for each of routeof's boxes. an endpoint that a
+// route goes to gets only what goes down its routes, and the others get
+// everything else
+func dests(sinks []*sink) ([][]*sink, error) {
+	d := make([][]*sink, len(rules)+1)
+	routed := map[*sink]bool{}
+	for i, rt := range rules {
+		for _, s := range sinks {
+			if s.name == rt.to {
+				d[i+1] = append(d[i+1], s)
+				routed[s] = true
+			}
+		}
+		if d[i+1] == nil {
+			return nil, fmt.Errorf("route to unknown endpoint: %q", rt.to)
+		}
+	}
+	for _, s := range sinks {
+		if !routed[s] {
+			d[0] = append(d[0], s)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	defer func(r routes) { rules = r }(rules)
+	rules = nil
+	for _, s := range []string{"to=a,level=ERROR|fatal", "to=b,match=user=\\d, id", "match=^x,y$,to=c"} {
+		if err := rules.Set(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	for _, tc := range []struct {
+		l    Log
+		want int
+	}{
+		{Log{M: "boom", A: map[string]any{"level": "error"}}, 1},
+		{Log{M: "boom", A: map[string]any{"level": json.RawMessage(`"FATAL"`)}}, 1},
+		{Log{M: "user=1, id=2"}, 2},
+		{Log{M: "x,y"}, 3},
+		{Log{M: "boom", A: map[string]any{"level": "info"}}, 0},
+		{Log{M: "user=1 id=2"}, 0},
+	} {
+		if have := routeof(tc.l); have != tc.want {
+			t.Errorf("%q %v: have route %d, want %d", tc.l.M, tc.l.A, have, tc.want)
+		}
+	}
+	for _, s := range []string{"level=error", "to=a", "to=a,bad=1", "to=a,match=("} {
+		if err := rules.Set(s); err == nil {
+			t.Errorf("%s: want an error", s)
+		}
+	}
+}
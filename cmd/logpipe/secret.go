@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// secret fetches the -keysource secret: aws-sm://name from aws secrets
+// manager, or gcp-sm://project/name from google's secret manager. it runs
+// their cli, aws or gcloud, so whatever credentials those are set up with
+// are used, and logpipe needs neither sdk. the cli has to be on $PATH
+//
+// the secret is the key, or a json object with a key field, and maybe a
+// url field too
+func secret(src string) (key, url string, err error) {
+	scheme, name, _ := strings.Cut(src, "://")
+	var args []string
+	switch scheme {
+	case "aws-sm":
+		args = []string{"aws", "secretsmanager", "get-secret-value", "--secret-id", name, "--query", "SecretString", "--output", "text"}
+	case "gcp-sm":
+		project, id, ok := strings.Cut(name, "/")
+		if !ok || project == "" || id == "" {
+			return "", "", fmt.Errorf("%q: want gcp-sm://project/name", src)
+		}
+		args = []string{"gcloud", "secrets", "versions", "access", "latest", "--secret", id, "--project", project}
+	default:
+		return "", "", fmt.Errorf("%q: want aws-sm://name or gcp-sm://project/name", src)
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("%q: no secret name", src)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	dbg("keysource: %s", strings.Join(args, " "))
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", "", fmt.Errorf("%s: needs the %s cli installed, and on $PATH", src, args[0])
+	}
+	if ee := (*exec.ExitError)(nil); errors.As(err, &ee) && len(ee.Stderr) > 0 {
+		err = fmt.Errorf("%s: %v: %s", args[0], err, strings.TrimSpace(string(ee.Stderr)))
+	}
+	if err != nil {
+		return "", "", err
+	}
+	s := strings.TrimSpace(string(out))
+	v := struct{ Key, URL string }{}
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return "", "", fmt.Errorf("%s: %v", src, err)
+		}
+		s = strings.TrimSpace(v.Key)
+	}
+	if s == "" {
+		return "", "", fmt.Errorf("%s: the secret is empty", src)
+	}
+	return s, strings.TrimSpace(v.URL), nil
+}
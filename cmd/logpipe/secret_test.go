@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	// a fake aws and gcloud that print their SECRET
+	dir := t.TempDir()
+	for _, name := range []string{"aws", "gcloud"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\nprintf '%s\\n' \"$SECRET\"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+	for _, tc := range []struct {
+		src, secret string
+		key, url    string
+	}{
+		{"aws-sm://nr", "abc", "abc", ""},
+		{"gcp-sm://proj/nr", " abc ", "abc", ""},
+		{"aws-sm://nr", `{"key":"abc","url":"http://a"}`, "abc", "http://a"},
+		{"aws-sm://nr", "", "", ""},
+		{"aws-sm://nr", `{"url":"http://a"}`, "", ""},
+		{"gcp-sm://nr", "abc", "", ""},
+		{"vault://nr", "abc", "", ""},
+	} {
+		t.Setenv("SECRET", tc.secret)
+		key, url, err := secret(tc.src)
+		if key != tc.key || url != tc.url || (err == nil) != (tc.key != "") {
+			t.Errorf("%s %q: have %q %q %v, want %q %q", tc.src, tc.secret, key, url, err, tc.key, tc.url)
+		}
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	for _, src := range []string{"aws-sm://nr", "gcp-sm://proj/nr"} {
+		if _, _, err := secret(src); err == nil || !strings.Contains(err.Error(), "on $PATH") {
+			t.Errorf("%s without the cli: have %v, want it to say so", src, err)
+		}
+	}
+}
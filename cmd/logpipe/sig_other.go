@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyDump does nothing, there is no SIGUSR1 here
+func notifyDump(c chan os.Signal) {}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDump sends SIGUSR1 to c, see dump
+func notifyDump(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// spool is an append-only file of boxes that failed to push, one json
+// encoded box per line. spooled boxes are replayed, oldest first, before
+// anything new is pushed
+type spool struct {
+	mu        sync.Mutex // -workers share it
+	replaying sync.Mutex // one replay at a time, appends dont wait for it
+	path      string
+	n         int       // boxes in the file
+	fails     int       // replays in a row that failed
+	after     time.Time // when deliver may replay again, see held
+}
+
+// openSpool counts the boxes left in path by a previous run, if any
+func openSpool(path string) (*spool, error) {
+	s := &spool{path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 4*payloadmax())
+	for sc.Scan() {
+		s.n++
+	}
+	return s, sc.Err()
+}
+
+func (s *spool) append(box Box) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(js(box) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	s.n++
+	return f.Close()
+}
+
+// replay pushes the spooled boxes to ep with send, push or retry, in
+// order. it stops at the first one that fails, and keeps it and everything
+// after it in the spool. boxes may be appended while it pushes, they are
+// kept after the rest, and replayed too
+func (s *spool) replay(c *http.Client, ep endpoint, send func(*http.Client, endpoint, Box) error) bool {
+	s.replaying.Lock()
+	defer s.replaying.Unlock()
+	for {
+		n := s.len()
+		if n == 0 {
+			s.failed(false)
+			return true
+		}
+		if !s.replayn(c, ep, send, n) {
+			s.failed(true)
+			return false
+		}
+	}
+}
+
+// failed backs off the next replay deliver would try, or resets it
+func (s *spool) failed(yes bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !yes {
+		s.fails, s.after = 0, time.Time{}
+		return
+	}
+	s.after = time.Now().Add(backoff(s.fails))
+	s.fails++
+}
+
+// held says whether the last replay failed and its backoff isnt up. until
+// it is, the endpoint is most likely still down, and new boxes go straight
+// to the spool without reading it all again
+func (s *spool) held() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.after)
+}
+
+// replayn replays the first n boxes, and says whether they all went
+func (s *spool) replayn(c *http.Client, ep endpoint, send func(*http.Client, endpoint, Box) error, n int) bool {
+	dbg("spool: replaying %d boxes", n)
+	lines, err := s.read()
+	if err != nil {
+		warn("spool: %v", err)
+		return false
+	}
+	if n > len(lines) {
+		n = len(lines)
+	}
+	done := 0 // lines pushed, or skipped
+	for _, line := range lines[:n] {
+		box := Box{}
+		if err := json.Unmarshal(line, &box); err != nil {
+			warn("spool: skipping bad entry: %v", err)
+			done++
+			continue
+		}
+		if err := send(c, ep, box); err != nil {
+			checkkey(err)
+			dbg("spool: %s: %v", ep, err)
+			break
+		}
+		done++
+	}
+	if done == 0 {
+		return false // nothing to rewrite
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lines, err = s.read(); err != nil {
+		warn("spool: %v", err)
+		return false
+	}
+	left := lines[done:]
+	if len(left) == 0 {
+		s.n = 0
+		dbg("spool: drained")
+		return os.Remove(s.path) == nil
+	}
+
+	// rewrite what is left, rename makes sure we never lose the old one
+	tmp := s.path + ".tmp"
+	w, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		warn("spool: %v", err)
+		return false
+	}
+	bw := bufio.NewWriter(w)
+	for _, l := range left {
+		bw.Write(l)
+		bw.WriteByte('\n')
+	}
+	if err = bw.Flush(); err == nil {
+		err = w.Close()
+	} else {
+		w.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		warn("spool: %v", err)
+		return false
+	}
+	dbg("spool: %d of %d boxes left", len(left), len(lines))
+	s.n = len(left)
+	return done == n
+}
+
+// read returns the lines in the spool
+func (s *spool) read() (lines [][]byte, err error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 4*payloadmax())
+	for sc.Scan() {
+		lines = append(lines, append([]byte{}, sc.Bytes()...))
+	}
+	return lines, sc.Err()
+}
+
+// len is how many boxes are spooled
+func (s *spool) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// fallback is the -fallback file, where the logs in boxes that couldnt
+// be pushed, and are not spooled, are written as a last resort, one json
+// log per line. unlike the spool, nothing reads it back
+type fallback struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// lastresort is nil without -fallback
+var lastresort *fallback
+
+// openFallback appends to path, or writes to stderr if path is "-"
+func openFallback(path string) (*fallback, error) {
+	if path == "-" {
+		return &fallback{w: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fallback{w: f}, nil
+}
+
+// keep writes the logs in box, and says whether it did
+func (f *fallback) keep(box Box) bool {
+	if f == nil {
+		return false
+	}
+	b := []byte{}
+	for _, l := range box.Log {
+		b = append(b, js(inline(l, box.Common))...)
+		b = append(b, '\n')
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.w.Write(b); err != nil {
+		warn("fallback: %v", err)
+		return false
+	}
+	return true
+}
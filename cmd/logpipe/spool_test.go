@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpoolReplay(t *testing.T) {
+	defer func(b time.Duration) { *maxback = b }(*maxback)
+	*maxback = time.Hour
+	path := filepath.Join(t.TempDir(), "spool")
+	sp, err := openSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.append(testBox("a"))
+	sp.append(testBox("b"))
+	before, _ := os.Stat(path)
+
+	pushed := []string{}
+	down := errors.New("down")
+	send := func(_ *http.Client, _ endpoint, b Box) error {
+		if down != nil {
+			return down
+		}
+		pushed = append(pushed, b.Log[0].M)
+		return nil
+	}
+	if sp.replay(client, endpoint{}, send) {
+		t.Fatal("replayed with the endpoint down")
+	}
+	if after, _ := os.Stat(path); !os.SameFile(before, after) || sp.len() != 2 {
+		t.Errorf("spool rewritten, %d boxes left, with nothing pushed", sp.len())
+	}
+	if !sp.held() {
+		t.Errorf("not held after a failed replay")
+	}
+
+	down = nil
+	sp.after = time.Time{} // the backoff is up
+	if !sp.replay(client, endpoint{}, send) || len(pushed) != 2 || pushed[0] != "a" || pushed[1] != "b" {
+		t.Errorf("have %q pushed, want a b", pushed)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || sp.len() != 0 || sp.held() {
+		t.Errorf("spool not drained: %v, %d boxes left", err, sp.len())
+	}
+}
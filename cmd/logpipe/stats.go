@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// stats are counted for the -stats summary. they are shared between
+// goroutines, so use sync/atomic on them
+var stats struct {
+	lines  int64 // read from the input
+	boxes  int64 // pushed successfully
+	bytes  int64 // sent in successful pushes, after compression
+	failed int64 // push attempts that failed, including retries
+	json   int64 // lines parsed that were json objects
+	plain  int64 // and that werent
+	blank  int64 // lines -skipblank skipped
+	sent   int64 // lines pushed
+	kept   int64 // lines spooled, in -fallback, or left in the -wal
+	lost   int64 // lines refused, or dropped after retries or at shutdown
+
+	blocked  int64 // lines the scanner waited to send, linec was full
+	dropped  int64 // lines dropped with -drop, linec or a queue was full
+	boxdrops int64 // boxes of them dropped from a full queue, -overflow ring
+
+	pending int64 // bytes in the boxes being collected, a gauge, see part
+	inbox   int64 // lines in them, a gauge
+	lastok  int64 // unix nanoseconds of the last successful push, or 0
+}
+
+var start = time.Now()
+
+// result is what the last push did, "ok" or its error, see dump
+var result atomic.Value
+
+func count(n *int64, delta int) {
+	atomic.AddInt64(n, int64(delta))
+}
+
+// part is one collector's share of a gauge, which is the sum of them, so
+// collectors with a flush= of their own dont overwrite each other
+type part struct {
+	n *int64
+	v int64
+}
+
+func (p *part) set(v int) {
+	atomic.AddInt64(p.n, int64(v)-p.v)
+	p.v = int64(v)
+}
+
+// pushed notes a successful push of n bytes
+func pushed(n int) {
+	count(&stats.boxes, 1)
+	count(&stats.bytes, n)
+	atomic.StoreInt64(&stats.lastok, time.Now().UnixNano())
+	result.Store("ok")
+}
+
+// lastpush returns when the last successful push was, or when we
+// started if there hasnt been one
+func lastpush() time.Time {
+	if t := atomic.LoadInt64(&stats.lastok); t != 0 {
+		return time.Unix(0, t)
+	}
+	return start
+}
+
+// watch warns when nothing has been pushed for longer than -stall, while
+// there are boxes waiting to be
+func watch(sinks []*sink) {
+	stalled := false
+	for range time.Tick(*stall / 4) {
+		waiting := 0
+		for _, s := range sinks {
+			waiting += s.q.bytes()
+		}
+		since := time.Since(lastpush())
+		switch {
+		case waiting > 0 && since > *stall && !stalled:
+			stalled = true
+			warn("stalled: no successful push in %s, %d bytes waiting", since.Round(time.Second), waiting)
+		case stalled && since < *stall:
+			stalled = false
+			warn("stalled: pushing again")
+		}
+	}
+}
+
+// dump prints a snapshot of what logpipe is doing, on SIGUSR1
+func dump(sinks []*sink) {
+	queued := 0
+	for _, s := range sinks {
+		queued += s.q.bytes()
+	}
+	last, _ := result.Load().(string)
+	if last == "" {
+		last = "none yet"
+	}
+	lines, inbox := atomic.LoadInt64(&stats.lines), atomic.LoadInt64(&stats.inbox)
+	pending := atomic.LoadInt64(&stats.pending)
+	since := time.Since(lastpush()).Round(time.Millisecond)
+	diag("info", map[string]any{
+		"lines": lines, "boxlines": inbox, "boxbytes": pending, "queued": queued,
+		"lastpush": since.Seconds(), "result": last,
+	}, "dump: %d lines read, %d lines in %d bytes being collected, %d bytes queued, last push %s ago, last result: %s",
+		lines, inbox, pending, queued, since, last)
+}
+
+// summary prints the stats to stderr if -stats is set
+func summary() {
+	if !*showstats {
+		return
+	}
+	lines, boxes := atomic.LoadInt64(&stats.lines), atomic.LoadInt64(&stats.boxes)
+	bytes, failed := atomic.LoadInt64(&stats.bytes), atomic.LoadInt64(&stats.failed)
+	took := time.Since(start).Round(time.Millisecond)
+	b, d := atomic.LoadInt64(&stats.blocked), atomic.LoadInt64(&stats.dropped)
+	bd := atomic.LoadInt64(&stats.boxdrops)
+	js, plain := atomic.LoadInt64(&stats.json), atomic.LoadInt64(&stats.plain)
+	blank := atomic.LoadInt64(&stats.blank)
+	sent, kept, lost := atomic.LoadInt64(&stats.sent), atomic.LoadInt64(&stats.kept), atomic.LoadInt64(&stats.lost)
+	over := limits()
+	if *logjson {
+		byvalue := map[string]int64{}
+		for _, kc := range over {
+			byvalue[kc.key] = kc.n
+		}
+		diag("info", map[string]any{
+			"lines": lines, "boxes": boxes, "bytes": bytes, "failed": failed,
+			"json": js, "plain": plain, "blank": blank,
+			"sent": sent, "kept": kept, "lost": lost,
+			"blocked": b, "dropped": d, "boxesdropped": bd, "seconds": took.Seconds(),
+			"ratelimited": byvalue,
+		}, "summary")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "logpipe: %d lines, %d boxes, %d bytes, %d failed pushes in %s\n",
+		lines, boxes, bytes, failed, took)
+	fmt.Fprintf(os.Stderr, "logpipe: %d json lines, %d plain\n", js, plain)
+	if kept+lost > 0 {
+		fmt.Fprintf(os.Stderr, "logpipe: %d lines pushed, %d spooled or kept, %d dropped\n", sent, kept, lost)
+	}
+	if blank > 0 {
+		fmt.Fprintf(os.Stderr, "logpipe: %d blank lines skipped\n", blank)
+	}
+	for i, kc := range over {
+		if i == 10 {
+			fmt.Fprintf(os.Stderr, "logpipe: and %d more values over -ratelimit\n", len(over)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "logpipe: %d lines of %s=%q over -ratelimit dropped\n", kc.n, *ratekey, kc.key)
+	}
+	if b+d > 0 {
+		fmt.Fprintf(os.Stderr, "logpipe: backpressure: %d lines blocked, %d dropped, %d boxes of them from a full -maxbuffer\n", b, d, bd)
+	}
+}
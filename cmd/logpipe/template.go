@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// tmpl is the -template the payload is made with, nil for newrelic's
+var tmpl *template.Template
+
+// parseTemplate parses the -template text, or the file named after an @
+func parseTemplate(s string) (*template.Template, error) {
+	if strings.HasPrefix(s, "@") {
+		b, err := os.ReadFile(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+	t, err := template.New("payload").Funcs(template.FuncMap{"json": js}).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	// fail now, not on the first push
+	_, err = execute(t, Box{Common: common(), Log: []Log{newLog("logpipe", 1)}})
+	return t, err
+}
+
+// batchdata is what a -template is executed with. each log is a map of
+// the message, timestamp and attributes, as newrelic would have them
+type batchdata struct {
+	Logs   []map[string]any
+	Common map[string]any // the common attributes, already in each log
+}
+
+func execute(t *template.Template, box Box) ([]byte, error) {
+	d := batchdata{Common: map[string]any{}}
+	if box.Common != nil {
+		d.Common = box.Common.A
+	}
+	for _, l := range box.Log {
+		m := map[string]any{}
+		dec := json.NewDecoder(strings.NewReader(js(inline(l, box.Common))))
+		dec.UseNumber() // or timestamps come out as 1.7e+12
+		dec.Decode(&m)
+		d.Logs = append(d.Logs, m)
+	}
+	b := &bytes.Buffer{}
+	err := t.Execute(b, d)
+	return b.Bytes(), err
+}
+
+// render is payload for a -template
+func render(box Box) []byte {
+	b, err := execute(tmpl, box)
+	if err != nil {
+		warn("template: %v", err)
+	}
+	return b
+}
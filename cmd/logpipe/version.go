@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	rtdebug "runtime/debug"
+	"strings"
+)
+
+// version, commit and date are set at build time, for -version and the
+// User-Agent, like this:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// release returns the version. if -ldflags didnt set them, the version,
+// commit and date are filled in from what go knows: the module version
+// with go install, the commit and its time with go build in a checkout
+func release() string {
+	bi, ok := rtdebug.ReadBuildInfo()
+	if !ok {
+		return version
+	}
+	if v := bi.Main.Version; version == "dev" && v != "" && v != "(devel)" {
+		version = strings.TrimPrefix(v, "v")
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && commit == "":
+			commit = s.Value
+		case s.Key == "vcs.time" && date == "":
+			date = s.Value
+		}
+	}
+	return version
+}
+
+// about is what -version prints
+func about() string {
+	s := "logpipe " + release()
+	if commit != "" {
+		s += " " + commit
+	}
+	if date != "" {
+		s += fmt.Sprintf(" (built %s)", date)
+	}
+	return s
+}
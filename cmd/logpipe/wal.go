@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// wal is the -wal file, a log of the boxes handed to an endpoint. a box
+// is written to it, and synced, before it is queued, and acked once it
+// has been pushed, refused, or spooled. the boxes a previous run didnt
+// ack are pushed again first, so a box is pushed at least once, and
+// maybe twice, if logpipe died before it could ack it.
+//
+// each line is +id and the json box, or -id for an ack. the file is
+// emptied whenever there is nothing left to ack, or rewritten with just
+// what is left once it grows past compactsize
+type wal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	next uint64
+	live map[uint64]string // the lines not acked yet
+	size int64             // bytes in the file
+}
+
+const compactsize = 64 << 20
+
+// openWAL opens path, and returns the boxes in it that were never acked,
+// in order
+func openWAL(path string) (w *wal, left []Box, err error) {
+	w = &wal{path: path, live: map[uint64]string{}}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 4*payloadmax())
+		for sc.Scan() {
+			line := sc.Text()
+			if strings.HasPrefix(line, "-") {
+				id, _ := strconv.ParseUint(line[1:], 10, 64)
+				delete(w.live, id)
+				continue
+			}
+			n, _, _ := strings.Cut(strings.TrimPrefix(line, "+"), " ")
+			id, err := strconv.ParseUint(n, 10, 64)
+			if err != nil || !strings.HasPrefix(line, "+") {
+				warn("wal: skipping bad entry: %.32q", line)
+				continue
+			}
+			w.live[id] = line
+			if id > w.next {
+				w.next = id
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, id := range w.ids() {
+		_, js, _ := strings.Cut(w.live[id], " ")
+		box := Box{}
+		if err := json.Unmarshal([]byte(js), &box); err != nil {
+			warn("wal: skipping bad entry: %v", err)
+			delete(w.live, id)
+			continue
+		}
+		box.wal = id
+		left = append(left, box)
+	}
+	if err := w.compact(); err != nil {
+		return nil, nil, err
+	}
+	if len(left) > 0 {
+		dbg("wal: %d boxes werent acked", len(left))
+	}
+	return w, left, nil
+}
+
+// ids returns the ids not acked yet, in order
+func (w *wal) ids() []uint64 {
+	ids := make([]uint64, 0, len(w.live))
+	for id := range w.live {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// write logs box, and returns it with its id. if it cant, it warns, and
+// the box is pushed anyway
+func (w *wal) write(box Box) Box {
+	if w == nil {
+		return box
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line := fmt.Sprintf("+%d %s", w.next+1, js(box))
+	err := w.append(line)
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		warn("wal: %v", err)
+		return box
+	}
+	w.next++
+	box.wal = w.next
+	w.live[box.wal] = line
+	return box
+}
+
+// ack forgets box, it wont be pushed again
+func (w *wal) ack(box Box) {
+	if w == nil || box.wal == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.live[box.wal]; !ok {
+		return
+	}
+	delete(w.live, box.wal)
+	var err error
+	if len(w.live) == 0 || w.size > compactsize {
+		err = w.compact()
+	} else {
+		err = w.append(fmt.Sprintf("-%d", box.wal))
+	}
+	if err != nil {
+		warn("wal: %v", err)
+	}
+}
+
+func (w *wal) append(line string) error {
+	n, err := w.f.WriteString(line + "\n")
+	w.size += int64(n)
+	return err
+}
+
+// compact rewrites the file with only what is left to ack. rename makes
+// sure we never lose the old one
+func (w *wal) compact() error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	size := int64(0)
+	for _, id := range w.ids() {
+		n, _ := bw.WriteString(w.live[id] + "\n")
+		size += int64(n)
+	}
+	if err = bw.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.path)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f, w.size = f, size
+	return nil
+}
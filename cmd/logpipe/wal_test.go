@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	w, left, err := openWAL(path)
+	if err != nil || len(left) != 0 {
+		t.Fatalf("new wal: %v, %d boxes left", err, len(left))
+	}
+	a, b, c := w.write(testBox("a")), w.write(testBox("b")), w.write(testBox("c"))
+	w.ack(b)
+	w.ack(b)
+	w.ack(Box{})
+
+	w, left, err = openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0].Log[0].M != "a" || left[1].Log[0].M != "c" {
+		t.Fatalf("have %v, want a and c left", left)
+	}
+	if left[0].wal != a.wal || left[1].wal != c.wal {
+		t.Fatalf("ids: have %d %d, want %d %d", left[0].wal, left[1].wal, a.wal, c.wal)
+	}
+	if d := w.write(testBox("d")); d.wal <= c.wal {
+		t.Fatalf("reused id %d", d.wal)
+	} else {
+		w.ack(d)
+	}
+	w.ack(left[0])
+	w.ack(left[1])
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Fatalf("fully acked wal isnt empty: %v", err)
+	}
+
+	os.WriteFile(path, []byte("+1 {\"logs\":[]}\nbad\n-7\n+2 {\"logs\":[{\"message\":\"x\",\"timestamp\":1}]}\n+3 {\"lo"), 0600)
+	_, left, err = openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[1].Log[0].M != "x" {
+		t.Fatalf("have %v, want the two good boxes", left)
+	}
+	if b, _ := os.ReadFile(path); strings.Contains(string(b), "bad") {
+		t.Fatalf("bad entry wasnt dropped: %q", b)
+	}
+}